@@ -0,0 +1,189 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestArrayTransform(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`INSERT INTO PESSOA VALUES (3, 'Cris', 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO": mongifylab.SimpleTransform,
+		"CIDADE": mongifylab.ArrayTransform,
+		"PESSOA": mongifylab.ArrayTransform,
+		"CLUBE":  mongifylab.SimpleTransform,
+		"SOCIO":  mongifylab.NxNTransform,
+	})
+	tree.SetArrayOptions("PESSOA", "NOME DESC", 2)
+	tree.SetFields("CIDADE", map[string]string{"PESSOA": "moradores"})
+
+	expected := `CLUBE
+	(N:N PESSOA)
+	SOCIO
+ESTADO
+	[]
+	CIDADE
+		[]
+		PESSOA
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	document := `{_id: {SIGLA: "SP"}, NOME: "Sao Paulo", 
+		CIDADE: [{ID: 1, NOME: "Campinas", ESTADO: "SP", 
+		moradores: [{ID: 3, NOME: "Cris", CIDADE: 1}, {ID: 2, NOME: "Bia", CIDADE: 1}, ]}, ]}`
+	if !strings.Contains(script, document) {
+		t.Errorf("missing %s in:\n%s", document, script)
+	}
+}
+
+func TestArrayParent(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`INSERT INTO SOCIO VALUES (1, 1)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"CLUBE":  mongifylab.ReferencedTransform,
+		"PESSOA": mongifylab.SimpleTransform,
+		"SOCIO":  mongifylab.ArrayTransform,
+	})
+
+	// top entities that are not referenced hold the arrays first
+	expected := `CLUBE
+PESSOA
+	[]
+	SOCIO
+		-> CLUBE
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+
+	tree.SetArrayParent("SOCIO", "CLUBE")
+	expected = `CLUBE
+	[]
+	SOCIO
+PESSOA
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+	if issues := tree.Validate(); mongifylab.HasErrors(issues) {
+		t.Error("unexpected errors:", issues)
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := `{_id: {ID: 1}, NOME: "Xadrez", 
+		SOCIO: [{PESSOA: 1, CLUBE: 1}, ]}`
+	if !strings.Contains(script, document) {
+		t.Errorf("missing %s in:\n%s", document, script)
+	}
+	if strings.Count(script, "SOCIO: [") != 1 {
+		t.Error("arrays written under more than one parent:\n" + script)
+	}
+
+	// lookup tables hold no arrays, the parent asked for is an error
+	tree.Add("CLUBE", mongifylab.LookupTransform)
+	expected = `PESSOA
+	[]
+	SOCIO
+		-> CLUBE
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+
+	issue := "error: SOCIO: array of CLUBE, but it does not refer to it or it holds no arrays"
+	found := false
+	for _, got := range tree.Validate() {
+		found = found || got.String() == issue
+	}
+	if !found {
+		t.Error("missing issue:", issue)
+	}
+}
+
+func TestArrayMaxItemsQuery(t *testing.T) {
+	for _, test := range []struct {
+		dialect *mongifylab.Dialect
+		top     string
+	}{
+		{mongifylab.Oracle, `ROW_NUMBER() OVER (PARTITION BY "PESSOA"."CIDADE" ORDER BY NOME DESC, "PESSOA"."ID") AS "ROW_NUMBER" FROM "PESSOA" WHERE ("PESSOA"."CIDADE" IN (:1, :2))) "TOP_ROWS" WHERE "ROW_NUMBER" <= :3 ORDER BY "ROW_NUMBER"`},
+		{mongifylab.Postgres, `ROW_NUMBER() OVER (PARTITION BY "PESSOA"."CIDADE" ORDER BY NOME DESC, "PESSOA"."ID") AS "ROW_NUMBER" FROM "PESSOA" WHERE ("PESSOA"."CIDADE" IN ($1, $2))) "TOP_ROWS" WHERE "ROW_NUMBER" <= $3 ORDER BY "ROW_NUMBER"`},
+		{mongifylab.MySQL, "ROW_NUMBER() OVER (PARTITION BY `PESSOA`.`CIDADE` ORDER BY NOME DESC, `PESSOA`.`ID`) AS `ROW_NUMBER` FROM `PESSOA` WHERE (`PESSOA`.`CIDADE` IN (?, ?))) `TOP_ROWS` WHERE `ROW_NUMBER` <= ? ORDER BY `ROW_NUMBER`"},
+		{mongifylab.SQLite, `ROW_NUMBER() OVER (PARTITION BY "PESSOA"."CIDADE" ORDER BY NOME DESC, "PESSOA"."ID") AS "ROW_NUMBER" FROM "PESSOA" WHERE ("PESSOA"."CIDADE" IN (?, ?))) "TOP_ROWS" WHERE "ROW_NUMBER" <= ? ORDER BY "ROW_NUMBER"`},
+	} {
+		tree := &mongifylab.DependencyTree{Dialect: test.dialect, NxN: make(map[string]*mongifylab.TableNode)}
+		tree.Prepared.Tables = []string{"CIDADE", "PESSOA"}
+		tree.Prepared.Cols = map[string][]string{"CIDADE": {"ID"}, "PESSOA": {"ID", "NOME", "CIDADE"}}
+		tree.Prepared.PKs = map[string][]string{"CIDADE": {"ID"}, "PESSOA": {"ID"}}
+		tree.Prepared.FKs = map[string]map[string]mongifylab.FKInfo{
+			"PESSOA": {"CIDADE": {Columns: []string{"CIDADE"}, ForeignColumns: []string{"ID"}}},
+		}
+		tree.Add("CIDADE", mongifylab.SimpleTransform)
+		tree.Add("PESSOA", mongifylab.ArrayTransform)
+		tree.SetArrayOptions("PESSOA", "NOME DESC", 2)
+
+		query := tree.QueryArray(tree.Root[0].Arrays[0], []string{"CIDADE"}, [][]interface{}{{1}, {2}})
+		if !strings.HasPrefix(query.SQL, "SELECT * FROM (SELECT ") || !strings.HasSuffix(query.SQL, test.top) {
+			t.Errorf("%s: unexpected query %s", test.dialect.Name, query.SQL)
+		}
+		if len(query.Args) != 3 || query.Args[2] != 2 {
+			t.Errorf("%s: expected the keys and the most items as args, got %v", test.dialect.Name, query.Args)
+		}
+	}
+}
+
+func TestArrayOrderTies(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "APELIDO")
+	defer sqlite.Close()
+
+	// every nickname ties on the order, which SQLite reads backwards by the
+	// primary key
+	_, err := sqlite.Exec(`
+	INSERT INTO APELIDO VALUES (1, 'Zeca');
+	INSERT INTO APELIDO VALUES (1, 'Mana');
+	INSERT INTO APELIDO VALUES (1, 'Aninha');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Add("APELIDO", mongifylab.ArrayTransform)
+
+	// ties are broken by the primary key, the arrays being cut down or not
+	for _, test := range []struct {
+		maxItems int
+		expected string
+	}{
+		{0, `{PESSOA: 1, APELIDO: "Aninha"}, {PESSOA: 1, APELIDO: "Mana"}, {PESSOA: 1, APELIDO: "Zeca"}, ]`},
+		{2, `{PESSOA: 1, APELIDO: "Aninha"}, {PESSOA: 1, APELIDO: "Mana"}, ]`},
+	} {
+		tree.SetArrayOptions("APELIDO", `"APELIDO"."PESSOA" DESC`, test.maxItems)
+		script, err := tree.CreateCollectionScript(sqlite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(script, test.expected) {
+			t.Errorf("%d items: missing %s in:\n%s", test.maxItems, test.expected, script)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package mongifylab
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+)
+
+// SetAttributes sets the columns of an added attribute table holding the
+// name and the value of each attribute, the first two of its own if empty,
+// and whether they are written as an array of {k, v} documents instead of
+// an object keyed by name
+func (t *DependencyTree) SetAttributes(table, key, value string, asArray bool) {
+	if added := t.added(table); added != nil {
+		added.AttributeKey = key
+		added.AttributeValue = value
+		added.AttributeArray = asArray
+	}
+}
+
+// attributeColumns returns the columns of an attribute table holding the
+// name and the value of each attribute, out of its foreign keys unless set
+func (t *DependencyTree) attributeColumns(table string) (key, value string) {
+	var own []string
+	for _, col := range t.Prepared.Cols[table] {
+		isForeign := false
+		for _, fk := range t.Prepared.FKs[table] {
+			isForeign = isForeign || containsString(fk.Columns, col)
+		}
+		if !isForeign {
+			own = append(own, col)
+		}
+	}
+	if len(own) > 0 {
+		key = own[0]
+	}
+	if len(own) > 1 {
+		value = own[1]
+	}
+
+	if added := t.added(table); added != nil {
+		if added.AttributeKey != "" {
+			key = added.AttributeKey
+		}
+		if added.AttributeValue != "" {
+			value = added.AttributeValue
+		}
+	}
+	return key, value
+}
+
+// isAttribute tells whether table is an attribute table
+func (t *DependencyTree) isAttribute(table string) bool {
+	added := t.added(table)
+	return added != nil && added.Mode == AttributeTransform
+}
+
+// attributeArray prepares the array column of an attribute table,
+// whose elements are {k, v} documents, or the object pivoting them
+func (t *DependencyTree) attributeArray(arrayCol *BsonColumn) {
+	key, value := t.attributeColumns(arrayCol.Name)
+
+	keyCol := NewColumn(arrayCol.Name, key)
+	keyCol.Field = "k"
+	valueCol := NewColumn(arrayCol.Name, value)
+	valueCol.Field = "v"
+
+	arrayCol.InnerColumns = []*BsonColumn{keyCol, valueCol}
+	arrayCol.attribute = true
+	arrayCol.pivot = !t.added(arrayCol.Name).AttributeArray
+}
+
+// writePivot writes the attribute rows of c as an object keyed by their names
+func (t *DependencyTree) writePivot(buf *bytes.Buffer, c *BsonColumn, rows []map[string]interface{}) {
+	keyCol, valueCol := c.InnerColumns[0], c.InnerColumns[1]
+
+	sep := "\n\t\t" + c.Field + ": {"
+	for _, row := range rows {
+		key, value := t.columnValue(keyCol, row), t.columnValue(valueCol, row)
+		if key == nil || value == nil {
+			continue
+		}
+
+		if valueStr := valueString(value); valueStr != "" {
+			buf.WriteString(sep)
+			buf.WriteString(strconv.Quote(fmt.Sprint(key)) + ": " + valueStr)
+			sep = ", "
+		}
+	}
+	if sep == ", " {
+		buf.WriteRune('}')
+	}
+}
+
+// attributeIndexes returns the dotted paths of the attribute arrays among
+// cols, each one to be indexed by its names and values
+func attributeIndexes(cols []*BsonColumn, prefix string) []string {
+	var paths []string
+	for _, c := range cols {
+		switch {
+		case c.attribute && !c.pivot:
+			paths = append(paths, prefix+c.Field)
+		case c.variant != "":
+			paths = append(paths, attributeIndexes(c.InnerColumns, prefix)...)
+		case len(c.InnerColumns) > 0 && !c.attribute:
+			paths = append(paths, attributeIndexes(c.InnerColumns, prefix+c.Field+".")...)
+		}
+	}
+	return paths
+}
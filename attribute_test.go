@@ -0,0 +1,52 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestAttributeTransform(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "ATRIBUTO")
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`
+	INSERT INTO ATRIBUTO VALUES (1, 'olhos', 'verdes');
+	INSERT INTO ATRIBUTO VALUES (1, 'altura', '1,70');`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Add("ATRIBUTO", mongifylab.AttributeTransform)
+	tree.SetArrayOptions("ATRIBUTO", "CHAVE", 0)
+	tree.SetFields("PESSOA", map[string]string{"ATRIBUTO": "atributos"})
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `
+		atributos: {"altura": "1,70", "olhos": "verdes"}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	tree.SetAttributes("ATRIBUTO", "", "", true)
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `
+		atributos: [{k: "altura", v: "1,70"}, {k: "olhos", v: "verdes"}, ]}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+	if index := tree.CreateIndexScript(); !strings.Contains(index, `db.PESSOA.createIndex({"atributos.k": 1, "atributos.v": 1})`) {
+		t.Error("expected an index on the attributes in:\n", index)
+	}
+
+	tree.SetAttributes("ATRIBUTO", "NOME", "", false)
+	if issues := tree.Validate(); !mongifylab.HasErrors(issues) {
+		t.Errorf("expected an error for unknown attribute columns, got %v", issues)
+	}
+}
@@ -4,21 +4,38 @@ import (
 	"bytes"
 	"database/sql"
 	"fmt"
-	"log"
+	"strings"
 	"time"
 )
 
 // CreateCollectionScript returns the script for creating and populating the
-// a corresponding collection on mongodb
+// a corresponding collection on mongodb.
+// Every table is read from the same snapshot, recorded in the script header.
+// Mappings Validate finds errors in are refused with a *ValidationError.
 func (t *DependencyTree) CreateCollectionScript(db *sql.DB) (string, error) {
+	if err := t.checkValid(); err != nil {
+		return "", err
+	}
+
+	snapshot, err := t.dialect().BeginSnapshot(db)
+	if err != nil {
+		return "", err
+	}
+	defer snapshot.Rollback()
+
 	var buf bytes.Buffer
+	if snapshot.Marker != "" {
+		buf.WriteString("/* Snapshot: " + snapshot.Marker + " */\n\n")
+	}
+
 	sep := ""
 	for _, table := range t.Root {
 		buf.WriteString(sep)
 		buf.WriteString("/* " + table.Name + " */\n")
-		buf.WriteString("db.createCollection(\"" + table.Name + "\")\n")
-		buf.WriteString("db." + table.Name + ".insert([")
-		script, err := t.toBSON(table, db)
+		collection := t.CollectionName(table.Name)
+		buf.WriteString("db.createCollection(\"" + collection + "\")\n")
+		buf.WriteString("db." + collection + ".insert([")
+		script, err := t.toBSON(table, snapshot)
 		if err != nil {
 			return "", err
 		}
@@ -27,6 +44,10 @@ func (t *DependencyTree) CreateCollectionScript(db *sql.DB) (string, error) {
 		sep = "\n"
 	}
 
+	if err := t.writeArrayCollections(&buf, snapshot); err != nil {
+		return "", err
+	}
+
 	return buf.String(), nil
 }
 
@@ -34,28 +55,39 @@ func (t *DependencyTree) CreateIndexScript() string {
 	var buf bytes.Buffer
 
 	for _, table := range t.Root {
-		written := false
-		for _, un := range t.Prepared.UNs[table.Name] {
+		collection := t.CollectionName(table.Name)
+		index := func(cols []string, options string) {
+			buf.WriteString("db.")
+			buf.WriteString(collection)
+			buf.WriteString(".createIndex({")
 			sep := ""
-			for _, field := range un {
-				if !written {
-					written = true
-					buf.WriteString("/* ")
-					buf.WriteString(table.Name)
-					buf.WriteString(" */\n")
-					buf.WriteString("db.")
-					buf.WriteString(table.Name)
-					buf.WriteString(".createIndex({")
-				}
-
+			for _, col := range cols {
 				buf.WriteString(sep)
-				buf.WriteString(field)
+				buf.WriteString(fieldKey(t.fieldPath(table, col)))
 				buf.WriteString(": 1")
 				sep = ", "
 			}
-			buf.WriteString("})\n")
+			buf.WriteString("}" + options + ")\n")
+		}
+
+		// documents identified by ObjectIds keep their natural key unique
+		natural := t.References == ObjectIdReference && len(t.Prepared.PKs[table.Name]) > 0
+		// attribute arrays are searched by name and value
+		attributes := attributeIndexes(t.prepareColumns(nil, table, table.Name, false), "")
+		indexed := natural || len(t.Prepared.UNs[table.Name]) > 0 || len(attributes) > 0
+		if indexed {
+			buf.WriteString("/* " + table.Name + " */\n")
+		}
+		if natural {
+			index(t.Prepared.PKs[table.Name], ", {unique: true}")
+		}
+		for _, un := range t.Prepared.UNs[table.Name] {
+			index(un, "")
+		}
+		for _, path := range attributes {
+			buf.WriteString("db." + collection + ".createIndex({" + fieldKey(path+".k") + ": 1, " + fieldKey(path+".v") + ": 1})\n")
 		}
-		if written {
+		if indexed {
 			buf.WriteString("\n")
 		}
 	}
@@ -63,95 +95,181 @@ func (t *DependencyTree) CreateIndexScript() string {
 	return buf.String()
 }
 
-func (t *DependencyTree) toBSON(table *TableNode, db *sql.DB) (string, error) {
-	// Query all rows
-	query := t.QueryForAll(table)
-	rows, err := db.Query(query)
-	if err != nil {
-		return "", err
+// fieldKey writes the dotted path of a field as a key of a mongodb document
+func fieldKey(path string) string {
+	if strings.Contains(path, ".") {
+		return "\"" + path + "\""
 	}
-	// log.Println(query)
+	return path
+}
 
-	cols := t.prepareColumns(db, table, false)
+func (t *DependencyTree) toBSON(table *TableNode, db Querier) (string, error) {
+	var buf bytes.Buffer
+	err := t.eachDocument(db, table, t.selectAll(table, nil), func(doc, _ string) {
+		buf.WriteString("\n\t")
+		buf.WriteString(doc)
+		buf.WriteString(",")
+	})
 
-	rowMapChan, err := RowMapChan(rows)
-	if err != nil {
+	return buf.String(), err
+}
+
+// eachDocument renders each row selected by b as a document of table,
+// handing it to write along with the filter matching the document by its _id.
+// Rows are read in pages of lookupBatchSize, following the primary key of
+// table, and each page is read to the end before its arrays are fetched,
+// as the queries of the snapshot share a single connection.
+// Tables without a primary key, or sampled, are read in a single page,
+// as a sample would be drawn anew for each page.
+func (t *DependencyTree) eachDocument(db Querier, table *TableNode, b *selectBuilder, write func(doc, filter string)) error {
+	cols := t.prepareColumns(db, table, table.Name, false)
+
+	pks := t.Prepared.PKs[table.Name]
+	paged := len(pks) > 0
+	if added := t.added(table.Name); added != nil && added.Sample > 0 && added.Sample < 100 {
+		paged = false
+	}
+
+	var after []interface{}
+	for {
+		if paged {
+			b.Page(b.paths[table.Name], pks, after, lookupBatchSize)
+		}
+		page, err := b.Query().All(db)
+		if err != nil {
+			return err
+		}
+
+		// arrays are fetched for the whole page at once
+		if err := t.prefetch(db, cols, page); err != nil {
+			return err
+		}
+		for _, rowMap := range page {
+			doc, err := t.document(db, cols, rowMap)
+			if err != nil {
+				return err
+			}
+
+			// the first column is always _id
+			write(doc, "{"+t.Bson(cols[0], db, rowMap)+"}")
+		}
+
+		if !paged || len(page) < lookupBatchSize {
+			return nil
+		}
+		last := page[len(page)-1]
+		after = after[:0:0]
+		for _, pk := range pks {
+			after = append(after, last[table.Name+"."+pk])
+		}
+	}
+}
+
+// document renders the row m as a document holding cols,
+// refusing rows of overlapping subtypes
+func (t *DependencyTree) document(db Querier, cols []*BsonColumn, m map[string]interface{}) (string, error) {
+	if err := t.checkVariants(cols, m); err != nil {
 		return "", err
 	}
 
-	// for each row on the table
 	var buf bytes.Buffer
-	for rowMap := range rowMapChan {
-		buf.WriteString("\n\t")
-		sep := "{"
-		for _, col := range cols {
-			if str := t.Bson(col, db, rowMap); str != "" {
-				buf.WriteString(sep)
-				buf.WriteString(str)
-				sep = ", "
-			}
+	buf.WriteRune('{')
+	sep := ""
+	for _, col := range cols {
+		if str := t.Bson(col, db, m); str != "" {
+			buf.WriteString(sep)
+			buf.WriteString(str)
+			sep = ", "
 		}
-		buf.WriteString("},")
 	}
+	buf.WriteRune('}')
 
 	return buf.String(), nil
 }
 
 type BsonColumn struct {
-	Table        string
-	Name         string
+	Table string
+	Name  string
+
+	// Field is the name of the column in the document,
+	// Name unless it was renamed
+	Field string
+
+	// Path is the path of table names by which Table was joined,
+	// it identifies the column among the row's, as PATH.NAME
+	Path string
+
 	InnerColumns []*BsonColumn
 	IsArray      bool
+
+	// hook is the name of the hook computing the column, if any
+	hook string
+
+	// value is written instead of the row's, if not nil
+	value interface{}
+
+	// objectID tells whether the column holds the ObjectId of the row
+	objectID bool
+
+	// variant is the discriminator of the subtype whose columns
+	// c holds, flattened into the document
+	variant string
+
+	// variants are the subtypes the discriminator field c tells apart
+	variants []*BsonColumn
+
+	// attribute tells whether the array column holds the {k, v} documents
+	// of an attribute table, pivot whether they are written instead as an
+	// object keyed by name
+	attribute bool
+	pivot     bool
+
+	// lookup holds the array rows prefetched for the current batch,
+	// lookup[ParentKey] = [Rows...]
+	lookup map[string][]map[string]interface{}
 }
 
 func NewColumn(table, name string) *BsonColumn {
-	return &BsonColumn{Table: table, Name: name}
+	return &BsonColumn{Table: table, Name: name, Field: name, Path: table}
 }
 
-func (t *DependencyTree) Bson(c *BsonColumn, db *sql.DB, m map[string]interface{}) string {
+// Bson writes the field of c in the row m, empty if it has no value.
+// Arrays are written from the rows prefetched for the batch of m.
+func (t *DependencyTree) Bson(c *BsonColumn, db Querier, m map[string]interface{}) string {
 	var buf bytes.Buffer
 
 	if c.IsArray {
-		fk := t.Prepared.FKs[c.Name][c.Table]
-		query := QueryNxN(fk.Columns, c.Name)
-
-		var vals []interface{}
-		for _, col := range fk.ForeignColumns {
-			vals = append(vals, m[c.Table+"."+col])
-		}
-
-		rows, err := db.Query(query, vals...)
-		if err != nil {
-			log.Println(err)
-			return ""
-		}
-
-		nxnChan, err := RowMapChan(rows)
-		if err != nil {
-			log.Println(err)
-			return ""
+		key, _ := t.arrayKey(c, m)
+		nxnRows := c.lookup[key]
+		if c.pivot {
+			t.writePivot(&buf, c, nxnRows)
+			return buf.String()
 		}
 
 		nxnWritten := false
-		for nxnMap := range nxnChan {
+		for _, nxnMap := range nxnRows {
+			elementWritten := false
 			sep := "{"
-			for col, val := range nxnMap {
-				if str := valueString(val); val != nil && str != "" {
-					if !nxnWritten {
-						nxnWritten = true
-						buf.WriteString("\n\t\t")
-						buf.WriteString(c.Name)
-						buf.WriteString(": [")
-					}
-
-					buf.WriteString(sep)
-					buf.WriteString(col)
-					buf.WriteString(": ")
-					buf.WriteString(str)
-					sep = ", "
+			write := func(str string) {
+				if !nxnWritten {
+					nxnWritten = true
+					buf.WriteString("\n\t\t")
+					buf.WriteString(c.Field)
+					buf.WriteString(": [")
+				}
+
+				elementWritten = true
+				buf.WriteString(sep)
+				buf.WriteString(str)
+				sep = ", "
+			}
+
+			for _, inner := range c.InnerColumns {
+				if str := t.Bson(inner, db, nxnMap); str != "" {
+					write(str)
 				}
 			}
-			if nxnWritten {
+			if elementWritten {
 				buf.WriteString("}, ")
 			}
 
@@ -162,7 +280,11 @@ func (t *DependencyTree) Bson(c *BsonColumn, db *sql.DB, m map[string]interface{
 
 	} else if len(c.InnerColumns) > 0 {
 		written := false
-		sep := c.Name + ": {"
+		sep := c.Field + ": {"
+		if c.variant != "" {
+			// variants are flattened into the document
+			sep = ""
+		}
 		for _, inner := range c.InnerColumns {
 			if innerBSON := t.Bson(inner, db, m); len(innerBSON) > 0 {
 				written = true
@@ -171,12 +293,12 @@ func (t *DependencyTree) Bson(c *BsonColumn, db *sql.DB, m map[string]interface{
 				sep = ", "
 			}
 		}
-		if written {
+		if written && c.variant == "" {
 			buf.WriteRune('}')
 		}
-	} else if value, found := m[c.Table+"."+c.Name]; found && value != nil {
+	} else if value := t.columnValue(c, m); value != nil {
 		if valueStr := valueString(value); valueStr != "" {
-			buf.WriteString(c.Name + ": ")
+			buf.WriteString(c.Field + ": ")
 			buf.WriteString(valueStr)
 		}
 	}
@@ -184,7 +306,7 @@ func (t *DependencyTree) Bson(c *BsonColumn, db *sql.DB, m map[string]interface{
 	return buf.String()
 }
 
-func (t *DependencyTree) prepareColumns(db *sql.DB, table *TableNode, isEmbedded bool) []*BsonColumn {
+func (t *DependencyTree) prepareColumns(db Querier, table *TableNode, path string, isEmbedded bool) []*BsonColumn {
 	var cols []*BsonColumn
 
 	pks := t.Prepared.PKs[table.Name]
@@ -193,8 +315,10 @@ func (t *DependencyTree) prepareColumns(db *sql.DB, table *TableNode, isEmbedded
 	embeddedCols := make(map[string]*TableNode) // embeddedCols[ColumnName] = ForeignTableNode
 	referencedCols := make(map[string]string)   // referencedCols[ColumnName] = ForeignTableName
 
+	// columns referring to merged tables are written plainly,
+	// the merged columns follow the table's own
 	for _, embedded := range table.Embedded {
-		if fk, found := fks[embedded.Name]; found {
+		if fk, found := fks[embedded.Name]; found && !t.merged(embedded.Name) {
 			for iCol := range fk.Columns {
 				embeddedCols[fk.Columns[iCol]] = embedded
 			}
@@ -211,34 +335,125 @@ func (t *DependencyTree) prepareColumns(db *sql.DB, table *TableNode, isEmbedded
 
 	written := make(map[string]bool) // written[ForeignTableName] = bool
 
+	// documents are identified by their primary key,
+	// or by an ObjectId if it is kept as plain fields
 	PKParent := &cols
-	if !isEmbedded {
+	if !isEmbedded && t.References == ObjectIdReference {
+		cols = append(cols, objectIDColumn(table.Name, path, "_id"))
+	} else if !isEmbedded {
 		id := NewColumn("", "_id")
 		cols = append(cols, id)
 		PKParent = &id.InnerColumns
 	}
 
+	// columns of the primary key are kept even if excluded,
+	// documents must be identified by them
 	for _, pk := range t.Prepared.PKs[table.Name] {
-		t.prepareSingleColumn(db, PKParent, table.Name, pk, embeddedCols, referencedCols, written)
+		t.prepareSingleColumn(db, PKParent, table.Name, path, pk, embeddedCols, referencedCols, written)
 	}
 
 	nonPks := removeDuplicate(t.Prepared.Cols[table.Name], pks)
 	for _, field := range nonPks {
-		t.prepareSingleColumn(db, &cols, table.Name, field, embeddedCols, referencedCols, written)
+		if t.excluded(table.Name, field) {
+			continue
+		}
+		t.prepareSingleColumn(db, &cols, table.Name, path, field, embeddedCols, referencedCols, written)
+	}
+
+	for _, embedded := range table.Embedded {
+		if t.merged(embedded.Name) {
+			cols = append(cols, t.mergedColumns(db, table.Name, embedded, path)...)
+		}
+	}
+
+	// subtypes follow as variants, told apart by the discriminator
+	// field of the topmost supertype, right after the key
+	if variants := t.subtypeColumns(db, table, path); len(variants) > 0 {
+		if !t.isSubtype(table.Name) {
+			at := len(t.Prepared.PKs[table.Name])
+			if !isEmbedded {
+				at = 1
+			}
+			if at > len(cols) {
+				at = len(cols)
+			}
+			cols = append(cols[:at], append([]*BsonColumn{t.discriminatorColumn(table.Name, variants)}, cols[at:]...)...)
+		}
+		cols = append(cols, variants...)
 	}
 
-	// nxn columns will be replaced with an array with multiple object values
-	if len(table.NxNProxy) > 0 {
-		nxn := table.NxNProxy[0]
+	// computed fields follow the columns, named as they are declared
+	for _, computed := range t.computedFields(table.Name) {
+		computedCol := NewColumn(table.Name, computed.Field)
+		computedCol.Path = path
+		computedCol.hook = computed.Hook
+		cols = append(cols, computedCol)
+	}
+
+	// nxn columns will be replaced with an array with multiple object values,
+	// one array per NxN table, named by it unless renamed.
+	// Elements hold the far side and the attributes of the junction,
+	// leaving out the columns referring back to table.
+	for _, nxn := range table.NxNProxy {
 		nxnCol := NewColumn(table.Name, nxn.Name)
+		nxnCol.Field = t.fieldName(table.Name, nxn.Name, true)
+		nxnCol.Path = path
 		nxnCol.IsArray = true
+
+		back := t.Prepared.FKs[nxn.Name][table.Name].Columns
+		for _, inner := range t.prepareColumns(db, nxn, nxn.Name, true) {
+			if inner.Table != nxn.Name || !containsString(back, inner.Name) {
+				nxnCol.InnerColumns = append(nxnCol.InnerColumns, inner)
+			}
+		}
 		cols = append(cols, nxnCol)
 	}
 
+	// arrays will be replaced with the documents of the rows referring to it,
+	// unless they are grouped into buckets of their own
+	for _, array := range table.Arrays {
+		if t.bucketed(array.Name) {
+			continue
+		}
+		arrayCol := NewColumn(table.Name, array.Name)
+		arrayCol.Field = t.fieldName(table.Name, array.Name, true)
+		arrayCol.Path = path
+		arrayCol.IsArray = true
+		if t.isAttribute(array.Name) {
+			t.attributeArray(arrayCol)
+		} else {
+			arrayCol.InnerColumns = t.prepareColumns(db, array, array.Name, true)
+		}
+		cols = append(cols, arrayCol)
+	}
+
 	return cols
 }
 
-func (t *DependencyTree) prepareSingleColumn(db *sql.DB, parent *[]*BsonColumn, table, col string, embeddedCols map[string]*TableNode,
+// mergedColumns returns the columns of merged flattened into the documents
+// of table at path, under its prefix if any, leaving out the key they are
+// joined by as table holds it already
+func (t *DependencyTree) mergedColumns(db Querier, table string, merged *TableNode, path string) []*BsonColumn {
+	mergedPath := path + "." + merged.Name
+	key := t.Prepared.FKs[table][merged.Name].ForeignColumns
+
+	var cols []*BsonColumn
+	for _, c := range t.prepareColumns(db, merged, mergedPath, true) {
+		if c.Table != merged.Name || c.Path != mergedPath || !containsString(key, c.Name) {
+			cols = append(cols, c)
+		}
+	}
+
+	if added := t.added(merged.Name); added.Prefix != "" {
+		prefixCol := NewColumn("", merged.Name)
+		prefixCol.Field = added.Prefix
+		prefixCol.InnerColumns = cols
+		return []*BsonColumn{prefixCol}
+	}
+	return cols
+}
+
+func (t *DependencyTree) prepareSingleColumn(db Querier, parent *[]*BsonColumn, table, path, col string, embeddedCols map[string]*TableNode,
 	referencedCols map[string]string, written map[string]bool) {
 
 	// embedded columns will be replaced with the whole other object
@@ -246,7 +461,8 @@ func (t *DependencyTree) prepareSingleColumn(db *sql.DB, parent *[]*BsonColumn,
 		if !written[embedded.Name] {
 			written[embedded.Name] = true
 			embeddedCol := NewColumn("", embedded.Name)
-			embeddedCol.InnerColumns = t.prepareColumns(db, embedded, true)
+			embeddedCol.Field = t.fieldName(table, embedded.Name, false)
+			embeddedCol.InnerColumns = t.prepareColumns(db, embedded, path+"."+embedded.Name, true)
 
 			*parent = append(*parent, embeddedCol)
 		}
@@ -255,16 +471,15 @@ func (t *DependencyTree) prepareSingleColumn(db *sql.DB, parent *[]*BsonColumn,
 	} else if referenced, found := referencedCols[col]; found {
 		if !written[referenced] {
 			written[referenced] = true
-			referencedCol := NewColumn("", referenced)
-			for _, referPK := range t.Prepared.PKs[referenced] {
-				referencedCol.InnerColumns = append(referencedCol.InnerColumns, NewColumn(referenced, referPK))
-			}
-
-			*parent = append(*parent, referencedCol)
+			field := t.fieldName(table, referenced, false)
+			*parent = append(*parent, t.referenceColumn(referenced, path+"."+referenced, field))
 		}
 		// column will be put plainly
 	} else {
-		*parent = append(*parent, NewColumn(table, col))
+		plainCol := NewColumn(table, col)
+		plainCol.Field = t.fieldName(table, col, false)
+		plainCol.Path = path
+		*parent = append(*parent, plainCol)
 	}
 }
 
@@ -278,6 +493,8 @@ func valueString(val interface{}) string {
 			return ""
 		}
 		return "\"" + val.(string) + "\""
+	case JS:
+		return string(val.(JS))
 	case time.Time:
 		t := val.(time.Time)
 		return "new Date(\"" + t.Format("2006-01-02") + "\")"
@@ -308,15 +525,29 @@ type QueryInput struct {
 	Text     string
 }
 
+// CreateFindScript returns the script finding the documents of table
+// matching any of the conditions on its columns, conditions[Column]
 func (t *DependencyTree) CreateFindScript(table string, conditions map[string]QueryInput) string {
 	var buf bytes.Buffer
 
 	buf.WriteString("db.")
-	buf.WriteString(table)
+	buf.WriteString(t.CollectionName(table))
 	buf.WriteString(".find({$or: {")
 
+	var node *TableNode
+	for _, root := range t.Root {
+		if root.Name == table {
+			node = root
+		}
+	}
+
 	sep := ""
-	for field, condition := range conditions {
+	for col, condition := range conditions {
+		field := t.fieldName(table, col, false)
+		if node != nil {
+			field = t.fieldPath(node, col)
+		}
+
 		var op string
 		switch condition.Operator {
 		case "=":
@@ -342,7 +573,7 @@ func (t *DependencyTree) CreateFindScript(table string, conditions map[string]Qu
 		}
 
 		buf.WriteString(sep)
-		buf.WriteString(field)
+		buf.WriteString(fieldKey(field))
 		buf.WriteString(": {")
 		buf.WriteString(op)
 		buf.WriteString(": ")
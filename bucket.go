@@ -0,0 +1,497 @@
+package mongifylab
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BucketWindows truncate times to the start of the window of the bucket
+// they fall in, by the window's name
+var BucketWindows = map[string]func(time.Time) time.Time{
+	"day": func(at time.Time) time.Time {
+		return time.Date(at.Year(), at.Month(), at.Day(), 0, 0, 0, 0, at.Location())
+	},
+	"month": func(at time.Time) time.Time {
+		return time.Date(at.Year(), at.Month(), 1, 0, 0, 0, 0, at.Location())
+	},
+	"year": func(at time.Time) time.Time {
+		return time.Date(at.Year(), 1, 1, 0, 0, 0, 0, at.Location())
+	},
+}
+
+// SetBucket groups the rows of an added array table into bucket documents
+// of a collection of their own, instead of the arrays of the rows of its
+// parent they refer to: by the window of column their time falls in, if
+// column is not empty, or else by size rows. Zero size and empty column
+// embed them again. As the table has a single parent, see SetArrayParent,
+// the buckets are of that one relationship.
+func (t *DependencyTree) SetBucket(table string, size int, column, window string) {
+	if added := t.added(table); added != nil {
+		added.BucketSize = size
+		added.BucketColumn = column
+		added.BucketWindow = window
+	}
+}
+
+// SetOverflow has the rows of an added array table beyond the MaxItems
+// first of each array of its parent written to a collection of their own
+func (t *DependencyTree) SetOverflow(table string, overflow bool) {
+	if added := t.added(table); added != nil {
+		added.Overflow = overflow
+	}
+}
+
+// bucketed tells whether the rows of table are grouped into buckets
+// instead of arrays
+func (t *DependencyTree) bucketed(table string) bool {
+	added := t.added(table)
+	return added != nil && added.Mode == ArrayTransform && (added.BucketSize > 0 || added.BucketColumn != "")
+}
+
+// BucketCollection returns the name of the collection of the buckets
+// of an array table
+func (t *DependencyTree) BucketCollection(table string) string {
+	return t.CollectionName(table) + "_buckets"
+}
+
+// OverflowCollection returns the name of the collection of the rows of an
+// array table left out of the arrays
+func (t *DependencyTree) OverflowCollection(table string) string {
+	return t.CollectionName(table) + "_overflow"
+}
+
+// spillCollection returns the collection the rows of an array table are
+// written to apart from the arrays of its parent, the one of its buckets
+// or of its overflow, empty if none
+func (t *DependencyTree) spillCollection(table string) string {
+	added := t.added(table)
+	switch {
+	case t.bucketed(table):
+		return t.BucketCollection(table)
+	case added != nil && added.Mode == ArrayTransform && added.Overflow && added.MaxItems > 0:
+		return t.OverflowCollection(table)
+	}
+	return ""
+}
+
+// writeArrayCollections writes the collections of the buckets and of the
+// overflow of every array table, once each, related to the documents of
+// its parent
+func (t *DependencyTree) writeArrayCollections(buf *bytes.Buffer, db Querier) error {
+	for _, added := range t.AddedTables {
+		array := added.Table
+		collection, parent := t.spillCollection(array.Name), t.parentOf(array.Name)
+		if collection == "" || parent == "" {
+			continue
+		}
+
+		script, err := t.spillBSON(db, array, parent, nil)
+		if err != nil {
+			return err
+		}
+
+		buf.WriteString("\n/* " + array.Name + " of " + parent + " */\n")
+		buf.WriteString("db.createCollection(\"" + collection + "\")\n")
+		if script != "" {
+			buf.WriteString("db." + collection + ".insert([")
+			buf.WriteString(script)
+			buf.WriteString("\n])\n")
+		}
+	}
+
+	return nil
+}
+
+// writeSpillRefresh writes the replacement of the buckets or the overflow of
+// array for each of keys, the keys of the parent rows they refer to
+func (t *DependencyTree) writeSpillRefresh(buf *bytes.Buffer, db Querier, array *TableNode, parent string, keys [][]interface{}) error {
+	collection := t.spillCollection(array.Name)
+	fk := t.Prepared.FKs[array.Name][parent]
+
+	// buckets are found by their _id, overflow documents as any other field
+	fields := make([]string, len(fk.Columns))
+	for i, col := range fk.Columns {
+		fields[i] = "_id." + t.fieldName(array.Name, col, false)
+		if !t.bucketed(array.Name) {
+			fields[i] = fieldPath(t.prepareColumns(nil, array, array.Name, false), array.Name, col, "")
+		}
+	}
+	if t.spillsObjectIDs(array.Name, parent) {
+		fields = []string{t.fieldName(array.Name, parent, false)}
+		if t.bucketed(array.Name) {
+			fields[0] = "_id." + fields[0]
+		}
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > lookupBatchSize {
+			batch = batch[:lookupBatchSize]
+		}
+		keys = keys[len(batch):]
+
+		for _, key := range batch {
+			vals := key
+			if id := t.spillParentID(array.Name, parent, key); id != nil {
+				vals = []interface{}{id}
+			}
+
+			buf.WriteString("db." + collection + ".deleteMany({")
+			for i, field := range fields {
+				if i > 0 {
+					buf.WriteString(", ")
+				}
+				buf.WriteString("\"" + field + "\": " + valueString(vals[i]))
+			}
+			buf.WriteString("})\n")
+		}
+
+		script, err := t.spillBSON(db, array, parent, batch)
+		if err != nil {
+			return err
+		}
+		if script != "" {
+			buf.WriteString("db." + collection + ".insert([")
+			buf.WriteString(script)
+			buf.WriteString("\n])\n")
+		}
+	}
+
+	return nil
+}
+
+// writeChangedSpills writes the replacement of the buckets and the overflow
+// of the parent rows that changed rows of array tables refer to, as told
+// by the array tables or the tables their rows hold being tracked
+func (t *DependencyTree) writeChangedSpills(buf *bytes.Buffer, db Querier) error {
+	for _, added := range t.AddedTables {
+		array := added.Table
+		parent := t.parentOf(array.Name)
+		if t.spillCollection(array.Name) == "" || parent == "" {
+			continue
+		}
+
+		var changes []string
+		b := t.selectAll(array, &changes)
+		if len(changes) == 0 {
+			continue
+		}
+		b.Where(strings.Join(changes, " OR "))
+
+		rows, err := b.Query().All(db)
+		if err != nil {
+			return err
+		}
+		keys := t.spillKeys(array.Name, parent, rows, make(map[string]bool))
+		if len(keys) == 0 {
+			continue
+		}
+
+		buf.WriteString("\n/* " + array.Name + " of " + parent + " */\n")
+		if err := t.writeSpillRefresh(buf, db, array, parent, keys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// writeSpillChanges writes the replacement of the buckets and the overflow
+// of the parent rows that the changed row of table, whose logged key is
+// vals, relates to. Parent rows in seen, by collection, are left out.
+func (t *DependencyTree) writeSpillChanges(buf *bytes.Buffer, db Querier, table string, vals map[string]interface{}, seen map[string]map[string]bool) error {
+	for _, added := range t.AddedTables {
+		array := added.Table
+		collection, parent := t.spillCollection(array.Name), t.parentOf(array.Name)
+		if collection == "" || parent == "" {
+			continue
+		}
+		if seen[collection] == nil {
+			seen[collection] = make(map[string]bool)
+		}
+
+		// rows of the array itself are found by their logged key,
+		// even when they are gone
+		var keys [][]interface{}
+		if table == array.Name {
+			m := make(map[string]interface{})
+			for col, val := range vals {
+				m[array.Name+"."+col] = val
+			}
+			keys = t.spillKeys(array.Name, parent, []map[string]interface{}{m}, seen[collection])
+		}
+
+		for _, target := range t.changeTargets(array, array, array.Name, table) {
+			if target.IsRoot {
+				continue
+			}
+
+			targetKeys, err := t.targetKeys(db, target, vals)
+			if err != nil {
+				return err
+			}
+			for _, batch := range keyBatches(targetKeys) {
+				b := t.selectAll(array, nil)
+				b.WhereIn(b.paths[target.Path], target.Cols, batch)
+				rows, err := b.Query().All(db)
+				if err != nil {
+					return err
+				}
+				keys = append(keys, t.spillKeys(array.Name, parent, rows, seen[collection])...)
+			}
+		}
+
+		if len(keys) > 0 {
+			if err := t.writeSpillRefresh(buf, db, array, parent, keys); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// spillKeys returns the keys of the parent rows that the rows of array in
+// rows refer to, once each, leaving out incomplete ones
+func (t *DependencyTree) spillKeys(array, parent string, rows []map[string]interface{}, seen map[string]bool) [][]interface{} {
+	fk := t.Prepared.FKs[array][parent]
+
+	var keys [][]interface{}
+	for _, m := range rows {
+		key := make([]interface{}, len(fk.Columns))
+		complete := true
+		for i, col := range fk.Columns {
+			key[i] = m[array+"."+col]
+			complete = complete && key[i] != nil
+		}
+
+		if k := lookupKey(key); complete && !seen[k] {
+			seen[k] = true
+			keys = append(keys, key)
+		}
+	}
+
+	return keys
+}
+
+// fieldPath returns the dotted name of the field of col of table among
+// cols, written plainly at path, empty if it is not written
+func fieldPath(cols []*BsonColumn, table, col, prefix string) string {
+	for _, c := range cols {
+		switch {
+		case c.IsArray:
+		case len(c.InnerColumns) > 0:
+			// variants are flattened into the document
+			innerPrefix := prefix + c.Field + "."
+			if c.variant != "" {
+				innerPrefix = prefix
+			}
+			if name := fieldPath(c.InnerColumns, table, col, innerPrefix); name != "" {
+				return name
+			}
+		case c.Table == table && c.Path == table && c.Name == col:
+			return prefix + c.Field
+		}
+	}
+	return ""
+}
+
+// spillBSON renders the buckets or the overflow of array referring to
+// parent, only the ones of the parent rows of keys if not nil
+func (t *DependencyTree) spillBSON(db Querier, array *TableNode, parent string, keys [][]interface{}) (string, error) {
+	if t.bucketed(array.Name) {
+		return t.bucketsBSON(db, array, parent, keys)
+	}
+	return t.overflowBSON(db, array, parent, keys)
+}
+
+// eachChild runs each row of array referring to parent through do, ordered
+// by the row they refer to, then by the bucketing column if any and then as
+// the arrays are, along with its key and its index among the rows referring
+// to the same one. Only the rows referring to keys are run if not nil.
+// Rows are read to the end and then handed over in batches,
+// with their inner arrays fetched.
+func (t *DependencyTree) eachChild(db Querier, array *TableNode, parent string, cols []*BsonColumn, keys [][]interface{}, do func(m map[string]interface{}, key []interface{}, i int) error) error {
+	fk := t.Prepared.FKs[array.Name][parent]
+	b := t.selectAll(array, nil)
+	alias := b.paths[array.Name]
+	if keys != nil {
+		b.WhereIn(alias, fk.Columns, keys)
+	}
+
+	// rows are ordered as QueryArray cuts the arrays down, so that the
+	// overflow holds exactly the rows the arrays leave out
+	var order []string
+	for _, col := range fk.Columns {
+		order = append(order, b.Qualified(alias, col))
+	}
+	if added := t.added(array.Name); added.BucketColumn != "" {
+		order = append(order, b.Qualified(alias, added.BucketColumn))
+	}
+	order = append(order, t.arrayOrder(b, array.Name, alias)...)
+	b.OrderBy(strings.Join(order, ", "))
+
+	rowMaps, err := b.Query().All(db)
+	if err != nil {
+		return err
+	}
+
+	lastKey, i := "", 0
+	for _, batch := range batches(rowMaps) {
+		if err := t.prefetch(db, cols, batch); err != nil {
+			return err
+		}
+		for _, m := range batch {
+			key := make([]interface{}, len(fk.Columns))
+			for iCol, col := range fk.Columns {
+				key[iCol] = m[array.Name+"."+col]
+			}
+
+			if k := lookupKey(key); k != lastKey {
+				lastKey, i = k, 0
+			}
+			if err := do(m, key, i); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+
+	return nil
+}
+
+// bucketsBSON renders the rows of array referring to parent as bucket
+// documents, identified by the key of the row they refer to and the
+// bucket: the start of its window, null for rows of no time, or its number
+func (t *DependencyTree) bucketsBSON(db Querier, array *TableNode, parent string, keys [][]interface{}) (string, error) {
+	added := t.added(array.Name)
+	fk := t.Prepared.FKs[array.Name][parent]
+	cols := t.prepareColumns(db, array, array.Name, true)
+	truncate := BucketWindows[added.BucketWindow]
+
+	var buf bytes.Buffer
+	var id string
+	var items []string
+	flush := func() {
+		if len(items) == 0 {
+			return
+		}
+		buf.WriteString("\n\t{_id: " + id + ", count: " + strconv.Itoa(len(items)) + ", items: [")
+		buf.WriteString(strings.Join(items, ", "))
+		buf.WriteString("]},")
+		items = nil
+	}
+
+	err := t.eachChild(db, array, parent, cols, keys, func(m map[string]interface{}, key []interface{}, i int) error {
+		var bucket string
+		if added.BucketColumn != "" {
+			switch at := m[array.Name+"."+added.BucketColumn].(type) {
+			case nil:
+				bucket = "null"
+			case time.Time:
+				if truncate != nil {
+					at = truncate(at)
+				}
+				bucket = valueString(at)
+			default:
+				return fmt.Errorf("%s is bucketed by %s, but it holds %v, which is not a time", array.Name, added.BucketColumn, at)
+			}
+		} else {
+			bucket = strconv.Itoa(i / added.BucketSize)
+		}
+
+		var bucketID bytes.Buffer
+		bucketID.WriteRune('{')
+		if id := t.spillParentID(array.Name, parent, key); id != nil {
+			bucketID.WriteString(t.fieldName(array.Name, parent, false) + ": " + valueString(id) + ", ")
+		} else {
+			for iCol, col := range fk.Columns {
+				bucketID.WriteString(t.fieldName(array.Name, col, false) + ": " + valueString(key[iCol]) + ", ")
+			}
+		}
+		bucketID.WriteString("bucket: " + bucket + "}")
+
+		if bucketID.String() != id {
+			flush()
+			id = bucketID.String()
+		}
+		item, err := t.document(db, cols, m)
+		items = append(items, item)
+		return err
+	})
+	flush()
+
+	return buf.String(), err
+}
+
+// overflowBSON renders the rows of array referring to parent beyond the
+// MaxItems first of each array as documents of their own
+func (t *DependencyTree) overflowBSON(db Querier, array *TableNode, parent string, keys [][]interface{}) (string, error) {
+	maxItems := t.added(array.Name).MaxItems
+	fk := t.Prepared.FKs[array.Name][parent]
+	cols := t.prepareColumns(db, array, array.Name, false)
+
+	// the parent is referred to by its ObjectId in place of its key,
+	// read from the key as if the parent was joined at parentPath
+	parentPath := array.Name + "." + parent
+	objectIDs := t.spillsObjectIDs(array.Name, parent)
+	if objectIDs {
+		var own []*BsonColumn
+		referred := false
+		for _, c := range cols {
+			if c.Table != array.Name || c.Path != array.Name || !containsString(fk.Columns, c.Name) {
+				own = append(own, c)
+			} else if !referred {
+				referred = true
+				own = append(own, objectIDColumn(parent, parentPath, t.fieldName(array.Name, parent, false)))
+			}
+		}
+		cols = own
+	}
+
+	var buf bytes.Buffer
+	err := t.eachChild(db, array, parent, cols, keys, func(m map[string]interface{}, key []interface{}, i int) error {
+		if i < maxItems {
+			return nil
+		}
+		if objectIDs {
+			for iCol, col := range fk.ForeignColumns {
+				m[parentPath+"."+col] = key[iCol]
+			}
+		}
+
+		doc, err := t.document(db, cols, m)
+		buf.WriteString("\n\t" + doc + ",")
+		return err
+	})
+
+	return buf.String(), err
+}
+
+// spillsObjectIDs tells whether the buckets and the overflow of array refer
+// to the rows of parent by their ObjectIds, as the rows of parent are
+// identified by them and the rows of array refer to their primary key
+func (t *DependencyTree) spillsObjectIDs(array, parent string) bool {
+	pks := t.Prepared.PKs[parent]
+	fk := t.Prepared.FKs[array][parent]
+	return t.References == ObjectIdReference && len(pks) > 0 &&
+		len(fk.ForeignColumns) == len(pks) && len(removeDuplicate(pks, fk.ForeignColumns)) == 0
+}
+
+// spillParentID returns the ObjectId of the row of parent whose key is key,
+// nil if the buckets and the overflow of array refer to parent by its key
+func (t *DependencyTree) spillParentID(array, parent string, key []interface{}) interface{} {
+	if !t.spillsObjectIDs(array, parent) {
+		return nil
+	}
+
+	fk := t.Prepared.FKs[array][parent]
+	m := make(map[string]interface{}, len(key))
+	for i, col := range fk.ForeignColumns {
+		m[parent+"."+col] = key[i]
+	}
+	return t.objectID(objectIDColumn(parent, parent, ""), m)
+}
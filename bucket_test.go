@@ -0,0 +1,212 @@
+package mongifylab_test
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestBucketAndOverflow(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "VOTO")
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`
+	INSERT INTO PESSOA VALUES (3, 'Cris', 1);
+	INSERT INTO VOTO VALUES (1, 1, '2024-01-05');
+	INSERT INTO VOTO VALUES (2, 1, '2024-02-02');
+	INSERT INTO VOTO VALUES (3, 1, '2024-01-20');
+	INSERT INTO VOTO VALUES (4, 2, NULL);`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"CIDADE": mongifylab.SimpleTransform,
+		"PESSOA": mongifylab.ArrayTransform,
+		"VOTO":   mongifylab.ArrayTransform,
+	})
+	tree.SetArrayOptions("PESSOA", "NOME", 0)
+	tree.SetBucket("PESSOA", 2, "", "")
+	tree.SetBucket("VOTO", 0, "DATA", "month")
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`{_id: {ID: 1}, NOME: "Campinas", ESTADO: "SP"},`,
+		`{_id: {CIDADE: 1, bucket: 0}, count: 2, items: [{ID: 1, NOME: "Ana", CIDADE: 1}, {ID: 2, NOME: "Bia", CIDADE: 1}]},`,
+		`{_id: {CIDADE: 1, bucket: 1}, count: 1, items: [{ID: 3, NOME: "Cris", CIDADE: 1}]},`,
+		`{_id: {PESSOA: 1, bucket: new Date("2024-01-01")}, count: 2, items: [`,
+		`{_id: {PESSOA: 1, bucket: new Date("2024-02-01")}, count: 1, items: [{ID: 2, PESSOA: 1, DATA: new Date("2024-02-02")}]},`,
+		`{_id: {PESSOA: 2, bucket: null}, count: 1, items: [{ID: 4, PESSOA: 2}]},`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+	if strings.Count(script, `db.createCollection("VOTO_buckets")`) != 1 {
+		t.Error("expected the buckets collection to be created once in:\n", script)
+	}
+
+	if _, err := sqlite.Exec(`INSERT INTO VOTO VALUES (5, 1, X'6F6E74656D')`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.CreateCollectionScript(sqlite); err == nil || !strings.Contains(err.Error(), "not a time") {
+		t.Error("expected an error bucketing by what is not a time, got", err)
+	}
+	if _, err := sqlite.Exec(`DELETE FROM VOTO WHERE ID = 5`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.SetBucket("PESSOA", 0, "", "")
+	tree.SetBucket("VOTO", 0, "", "")
+	tree.SetArrayOptions("PESSOA", "NOME DESC", 1)
+	tree.SetOverflow("PESSOA", true)
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`PESSOA: [{ID: 3, NOME: "Cris", CIDADE: 1}, ]},`,
+		`db.PESSOA_overflow.insert([
+	{_id: {ID: 2}, NOME: "Bia", CIDADE: 1, `,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+
+	tree.SetArrayOptions("PESSOA", "", 0)
+	issues := tree.Validate()
+	if !mongifylab.HasErrors(issues) {
+		t.Errorf("expected an error overflowing unbounded arrays, got %v", issues)
+	}
+
+	mapping := tree.Mapping()
+	if !mapping.Tables[1].Overflow {
+		t.Errorf("expected PESSOA to overflow in the mapping, got %+v", mapping.Tables[1])
+	}
+	mapping.Tables[2].BucketWindow = "week"
+	if err := tree.SetMapping(mapping); err == nil {
+		t.Error("expected an error bucketing by an unknown window")
+	}
+}
+
+// newBucketTree returns the tree of CIDADE with PESSOA as its array,
+// tracked by ALTERADO
+func newBucketTree(t *testing.T) (*sql.DB, *mongifylab.DependencyTree) {
+	sqlite, tree := newSQLiteTree(t, "PESSOA.ALTERADO")
+	if _, err := sqlite.Exec(`
+	INSERT INTO CIDADE VALUES (2, 'Santos', 'SP');
+	INSERT INTO PESSOA VALUES (3, 'Cris', 2, 3);`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"CIDADE": mongifylab.SimpleTransform,
+		"PESSOA": mongifylab.ArrayTransform,
+	})
+	tree.SetChangeTracking("PESSOA", "ALTERADO", nil)
+
+	return sqlite, tree
+}
+
+func TestBucketDelta(t *testing.T) {
+	sqlite, tree := newBucketTree(t)
+	defer sqlite.Close()
+	tree.SetBucket("PESSOA", 1, "", "")
+
+	if _, err := tree.CreateDeltaScript(sqlite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(`UPDATE PESSOA SET NOME = 'Bea', ALTERADO = 4 WHERE ID = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := tree.CreateDeltaScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `db.PESSOA_buckets.deleteMany({"_id.CIDADE": 1})
+db.PESSOA_buckets.insert([
+	{_id: {CIDADE: 1, bucket: 0}, count: 1, items: [{ID: 1, NOME: "Ana", CIDADE: 1, ALTERADO: 1}]},
+	{_id: {CIDADE: 1, bucket: 1}, count: 1, items: [{ID: 2, NOME: "Bea", CIDADE: 1, ALTERADO: 4}]},
+])`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+	if strings.Contains(script, "CIDADE: 2") {
+		t.Error("unchanged buckets were written again:\n", script)
+	}
+}
+
+func TestOverflowPoller(t *testing.T) {
+	sqlite, tree := newBucketTree(t)
+	defer sqlite.Close()
+	tree.SetArrayOptions("PESSOA", "NOME", 1)
+	tree.SetOverflow("PESSOA", true)
+
+	updates := pollAfter(t, sqlite, tree, `
+	UPDATE PESSOA SET NOME = 'Aaron' WHERE ID = 2;
+	DELETE FROM PESSOA WHERE ID = 3;`)
+	for _, expected := range []string{
+		`db.PESSOA_overflow.deleteMany({"CIDADE": 1})
+db.PESSOA_overflow.insert([
+	{_id: {ID: 1}, NOME: "Ana", CIDADE: 1, ALTERADO: 1},
+])`,
+		`db.PESSOA_overflow.deleteMany({"CIDADE": 2})`,
+	} {
+		if !strings.Contains(updates, expected) {
+			t.Errorf("missing %s in:\n%s", expected, updates)
+		}
+	}
+	if strings.Count(updates, "deleteMany") != 2 {
+		t.Error("expected each overflow to be written once in:\n", updates)
+	}
+}
+
+func TestSpillObjectIds(t *testing.T) {
+	sqlite, tree := newBucketTree(t)
+	defer sqlite.Close()
+	tree.References = mongifylab.ObjectIdReference
+
+	// every person of a city ties on the order, broken by their key
+	tree.SetArrayOptions("PESSOA", `"PESSOA"."CIDADE"`, 0)
+	tree.SetBucket("PESSOA", 1, "", "")
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// buckets refer to the document of their city as its arrays would
+	start := strings.Index(script, `{_id: ObjectId("`)
+	if start < 0 {
+		t.Fatal("missing the ObjectId of the city in:\n" + script)
+	}
+	city := script[start+len(`{_id: `) : start+len(`{_id: ObjectId("")`)+24]
+	if !strings.HasPrefix(script[start:], "{_id: "+city+`, ID: 1, NOME: "Campinas"`) {
+		t.Fatal("expected Campinas first in:\n" + script)
+	}
+	for _, expected := range []string{
+		`{_id: {CIDADE: ` + city + `, bucket: 0}, count: 1, items: [{ID: 1, NOME: "Ana", CIDADE: 1, ALTERADO: 1}]},`,
+		`{_id: {CIDADE: ` + city + `, bucket: 1}, count: 1, items: [{ID: 2, NOME: "Bia", CIDADE: 1, ALTERADO: 2}]},`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+
+	// so do overflow documents, and the refresh of either
+	tree.SetBucket("PESSOA", 0, "", "")
+	tree.SetArrayOptions("PESSOA", `"PESSOA"."CIDADE"`, 1)
+	tree.SetOverflow("PESSOA", true)
+	updates := pollAfter(t, sqlite, tree, `UPDATE PESSOA SET NOME = 'Bea' WHERE ID = 2`)
+	expected := `db.PESSOA_overflow.deleteMany({"CIDADE": ` + city + `})
+db.PESSOA_overflow.insert([
+	{_id: ObjectId("`
+	if !strings.Contains(updates, expected) || !strings.Contains(updates, `ID: 2, NOME: "Bea", CIDADE: `+city+`, ALTERADO: 2},`) {
+		t.Errorf("missing %s in:\n%s", expected, updates)
+	}
+}
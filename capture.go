@@ -0,0 +1,645 @@
+package mongifylab
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChangeLogTable is where the triggers of CreateChangeLogScript log changes
+const ChangeLogTable = "MONGIFY_CHANGES"
+
+// changeKeySep separates the values of the key columns logged for each row,
+// the ones within values are escaped by changeKeyEscape, as is the escape
+// itself. Nulls are logged as changeKeyNull.
+const (
+	changeKeySep    = "|"
+	changeKeyEscape = `\`
+	changeKeyNull   = changeKeyEscape + "N"
+)
+
+// changeTimeLayout is how Oracle triggers log dates and timestamps
+const changeTimeLayout = "2006-01-02T15:04:05.999999999"
+
+// changeTimeMasks are the TO_CHAR masks writing dates and timestamps
+// as changeTimeLayout, whatever the session's NLS settings
+var changeTimeMasks = map[string]string{
+	"date":      `'YYYY-MM-DD"T"HH24:MI:SS'`,
+	"timestamp": `'YYYY-MM-DD"T"HH24:MI:SS.FF9'`,
+}
+
+// CreateChangeLogScript returns the script creating the change log table,
+// along with triggers logging every change of the added tables into it,
+// so they may be turned into updates by a ChangePoller.
+// Each change logs the values of the columns that the documents holding the
+// row can be found by, separated by "|". Updates log both the old and
+// the new values. Values are read back by their types in Prepared.Types.
+// Mappings Validate finds errors in are refused with a *ValidationError.
+func (t *DependencyTree) CreateChangeLogScript() (string, error) {
+	if err := t.checkValid(); err != nil {
+		return "", err
+	}
+
+	d := t.dialect()
+
+	var buf bytes.Buffer
+	switch d.Name {
+	case Oracle.Name:
+		buf.WriteString("CREATE SEQUENCE " + d.QuoteIdent(ChangeLogTable+"_SEQ") + ";\n\n")
+		buf.WriteString("CREATE TABLE " + d.QuoteIdent(ChangeLogTable) + " (\n")
+		buf.WriteString("\t\"ID\" NUMBER PRIMARY KEY,\n")
+		buf.WriteString("\t\"TABLE_NAME\" VARCHAR2(128) NOT NULL,\n")
+		buf.WriteString("\t\"OPERATION\" CHAR(1) NOT NULL,\n")
+		buf.WriteString("\t\"ROW_KEY\" VARCHAR2(4000)\n")
+		buf.WriteString(");\n")
+	case SQLite.Name:
+		buf.WriteString("CREATE TABLE IF NOT EXISTS " + d.QuoteIdent(ChangeLogTable) + " (\n")
+		buf.WriteString("\t\"ID\" INTEGER PRIMARY KEY AUTOINCREMENT,\n")
+		buf.WriteString("\t\"TABLE_NAME\" TEXT NOT NULL,\n")
+		buf.WriteString("\t\"OPERATION\" TEXT NOT NULL,\n")
+		buf.WriteString("\t\"ROW_KEY\" TEXT\n")
+		buf.WriteString(");\n")
+	default:
+		return "", fmt.Errorf("change capture is not supported for %s", d.Name)
+	}
+
+	triggers := make(map[string]string) // triggers[Name] = Table
+	for _, added := range t.AddedTables {
+		table := added.Table.Name
+		cols := t.keyColumns(table)
+		trigger := uniqueIdent(d, "MONGIFY_"+table, triggers)
+		triggers[trigger] = table
+
+		buf.WriteString("\n")
+		switch d.Name {
+		case Oracle.Name:
+			buf.WriteString("CREATE OR REPLACE TRIGGER " + d.QuoteIdent(trigger) + "\n")
+			buf.WriteString("AFTER INSERT OR UPDATE OR DELETE ON " + d.QuoteIdent(table) + " FOR EACH ROW\n")
+			buf.WriteString("BEGIN\n")
+			buf.WriteString("\tIF INSERTING THEN\n")
+			buf.WriteString("\t\t" + t.logChange(table, "I", ":NEW", cols) + ";\n")
+			buf.WriteString("\tELSIF UPDATING THEN\n")
+			buf.WriteString("\t\t" + t.logChange(table, "U", ":OLD", cols) + ";\n")
+			buf.WriteString("\t\t" + t.logChange(table, "U", ":NEW", cols) + ";\n")
+			buf.WriteString("\tELSE\n")
+			buf.WriteString("\t\t" + t.logChange(table, "D", ":OLD", cols) + ";\n")
+			buf.WriteString("\tEND IF;\n")
+			buf.WriteString("END;\n/\n")
+		case SQLite.Name:
+			buf.WriteString("CREATE TRIGGER " + d.QuoteIdent(trigger+"_I") + " AFTER INSERT ON " + d.QuoteIdent(table) + " BEGIN\n")
+			buf.WriteString("\t" + t.logChange(table, "I", "NEW", cols) + ";\n")
+			buf.WriteString("END;\n")
+			buf.WriteString("CREATE TRIGGER " + d.QuoteIdent(trigger+"_U") + " AFTER UPDATE ON " + d.QuoteIdent(table) + " BEGIN\n")
+			buf.WriteString("\t" + t.logChange(table, "U", "OLD", cols) + ";\n")
+			buf.WriteString("\t" + t.logChange(table, "U", "NEW", cols) + ";\n")
+			buf.WriteString("END;\n")
+			buf.WriteString("CREATE TRIGGER " + d.QuoteIdent(trigger+"_D") + " AFTER DELETE ON " + d.QuoteIdent(table) + " BEGIN\n")
+			buf.WriteString("\t" + t.logChange(table, "D", "OLD", cols) + ";\n")
+			buf.WriteString("END;\n")
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// logChange returns the statement logging a change of table,
+// with the key columns taken from the row named row (e.g. :NEW)
+func (t *DependencyTree) logChange(table, operation, row string, cols []string) string {
+	d := t.dialect()
+
+	var key bytes.Buffer
+	for i, col := range cols {
+		if i > 0 {
+			key.WriteString(" || '" + changeKeySep + "' || ")
+		}
+
+		value := row + "." + d.QuoteIdent(col)
+		if d.Name == Oracle.Name {
+			switch kind := columnKind(t.Prepared.Types[table][col]); kind {
+			case "date", "timestamp":
+				value = "TO_CHAR(" + value + ", " + changeTimeMasks[kind] + ")"
+			case "number":
+				value = "TO_CHAR(" + value + ", 'TM9', 'NLS_NUMERIC_CHARACTERS=''.,''')"
+			default:
+				value = "TO_CHAR(" + value + ")"
+			}
+		} else {
+			value = "CAST(" + value + " AS TEXT)"
+		}
+
+		escaped := "REPLACE(REPLACE(" + value + ", '" + changeKeyEscape + "', '" + changeKeyEscape + changeKeyEscape + "'), '" +
+			changeKeySep + "', '" + changeKeyEscape + changeKeySep + "')"
+		key.WriteString("COALESCE(" + escaped + ", '" + changeKeyNull + "')")
+	}
+	if len(cols) == 0 {
+		key.WriteString("NULL")
+	}
+
+	literal := "'" + strings.Replace(table, "'", "''", -1) + "'"
+	insert := "INSERT INTO " + d.QuoteIdent(ChangeLogTable) + " (\"TABLE_NAME\", \"OPERATION\", \"ROW_KEY\") VALUES ("
+	if d.Name == Oracle.Name {
+		insert = "INSERT INTO " + d.QuoteIdent(ChangeLogTable) + " (\"ID\", \"TABLE_NAME\", \"OPERATION\", \"ROW_KEY\") VALUES (" +
+			d.QuoteIdent(ChangeLogTable+"_SEQ") + ".NEXTVAL, "
+	}
+
+	return insert + literal + ", '" + operation + "', " + key.String() + ")"
+}
+
+// keyColumns returns the columns any document holding a row of table can be
+// found by: its primary key, its foreign keys and the columns others refer to.
+// They are logged for each changed row.
+func (t *DependencyTree) keyColumns(table string) []string {
+	var cols []string
+	add := func(newCols []string) {
+		for _, col := range newCols {
+			if !containsString(cols, col) {
+				cols = append(cols, col)
+			}
+		}
+	}
+
+	add(t.Prepared.PKs[table])
+
+	for _, foreign := range t.foreignTables(table) {
+		add(t.Prepared.FKs[table][foreign].Columns)
+	}
+
+	for _, other := range t.Prepared.Tables {
+		if fk, found := t.Prepared.FKs[other][table]; found {
+			add(fk.ForeignColumns)
+		}
+	}
+
+	return cols
+}
+
+// DefaultChangeWindow is the Window of ChangePollers that set none
+const DefaultChangeWindow = 1000
+
+// ChangePoller turns the changes logged by the triggers of
+// CreateChangeLogScript into updates of the documents holding the changed rows.
+//
+// Ids are taken from a sequence as changes are logged, not as they commit, so
+// a change may commit after others with higher ids were polled. Each poll
+// reads again the ids up to Window before LastID, skipping the ones this
+// poller already turned into updates: every change committed before LastID
+// moves Window ids past it is turned into updates once, later ones are
+// missed. A new poller turns the changes of its first window into updates
+// again, which rewrites their documents as they already are.
+type ChangePoller struct {
+	Tree *DependencyTree
+
+	// LastID is the id of the last change turned into updates
+	LastID int64
+
+	// Window is how many ids before LastID each poll reads again,
+	// DefaultChangeWindow if not above zero
+	Window int64
+
+	seen         map[int64]bool // ids of the window turned into updates
+	polled       []int64        // ids read by the last poll
+	polledLastID int64          // lastID returned by the last poll
+}
+
+// Poll returns the script updating every document affected by the changes
+// logged after LastID, or late within the window before it, along with
+// the id of the last of them.
+// Once the script is applied, LastID is to be set to that id: the changes
+// the poll read are then skipped by the following ones.
+// Documents are replaced as a whole, and the ones whose root row is
+// gone are deleted. The buckets and overflow of the parent rows of changed
+// array rows are written anew. The script is empty when nothing changed.
+func (p *ChangePoller) Poll(db *sql.DB) (script string, lastID int64, err error) {
+	t := p.Tree
+	if err := t.checkValid(); err != nil {
+		return "", p.LastID, err
+	}
+
+	// the changes of the last poll are done if LastID was advanced to it
+	if p.seen == nil {
+		p.seen = make(map[int64]bool)
+	}
+	if p.LastID == p.polledLastID {
+		for _, id := range p.polled {
+			p.seen[id] = true
+		}
+	}
+	p.polled = nil
+
+	window := p.Window
+	if window <= 0 {
+		window = DefaultChangeWindow
+	}
+	after := p.LastID - window
+	for id := range p.seen {
+		if id <= after || id > p.LastID {
+			delete(p.seen, id)
+		}
+	}
+
+	snapshot, err := t.dialect().BeginSnapshot(db)
+	if err != nil {
+		return "", p.LastID, err
+	}
+	defer snapshot.Rollback()
+
+	changes, ids, err := t.queryChanges(snapshot, after, p.seen)
+	if err != nil || len(changes) == 0 {
+		return "", p.LastID, err
+	}
+	lastID = p.LastID
+	for _, id := range ids {
+		if id > lastID {
+			lastID = id
+		}
+	}
+
+	var buf bytes.Buffer
+	if snapshot.Marker != "" {
+		buf.WriteString("/* Snapshot: " + snapshot.Marker + " */\n")
+	}
+
+	written := make(map[string]bool)            // written[Collection+Filter] = bool
+	spilled := make(map[string]map[string]bool) // spilled[Collection][ParentKey] = bool
+	for _, change := range changes {
+		vals := t.parseChangeKey(change.Table, change.Key)
+		for _, root := range t.Root {
+			for _, target := range t.changeTargets(root, root, root.Name, change.Table) {
+				if err := t.writeChangedDocuments(&buf, snapshot, target, vals, written); err != nil {
+					return "", p.LastID, err
+				}
+			}
+		}
+		if err := t.writeSpillChanges(&buf, snapshot, change.Table, vals, spilled); err != nil {
+			return "", p.LastID, err
+		}
+	}
+
+	p.polled, p.polledLastID = ids, lastID
+	return buf.String(), lastID, nil
+}
+
+// Run polls db every interval, handing each script to apply and then
+// advancing LastID, until polling or applying fails
+func (p *ChangePoller) Run(db *sql.DB, interval time.Duration, apply func(script string) error) error {
+	for {
+		script, lastID, err := p.Poll(db)
+		if err != nil {
+			return err
+		}
+
+		if script != "" {
+			if err := apply(script); err != nil {
+				// the changes are read again by the next poll
+				p.polled = nil
+				return err
+			}
+		}
+		p.LastID = lastID
+
+		time.Sleep(interval)
+	}
+}
+
+// loggedChange is a row of the change log
+type loggedChange struct {
+	Table string
+	Key   string
+}
+
+// queryChanges returns the changes logged after the id after, but for the
+// ones whose ids are in skip, once per changed row and in the order they
+// first happened, along with the ids of the changes read
+func (t *DependencyTree) queryChanges(db Querier, after int64, skip map[int64]bool) ([]loggedChange, []int64, error) {
+	d := t.dialect()
+	query := "SELECT \"ID\", \"TABLE_NAME\", \"ROW_KEY\" FROM " + d.QuoteIdent(ChangeLogTable) +
+		" WHERE \"ID\" > " + d.Bind(1) + " ORDER BY \"ID\""
+
+	rows, err := db.Query(query, after)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var changes []loggedChange
+	var ids []int64
+	seen := make(map[loggedChange]bool)
+	for rows.Next() {
+		var id int64
+		var change loggedChange
+		var key sql.NullString
+		if err := rows.Scan(&id, &change.Table, &key); err != nil {
+			return nil, nil, err
+		}
+		if skip[id] {
+			continue
+		}
+		ids = append(ids, id)
+
+		change.Key = key.String
+		if !seen[change] {
+			seen[change] = true
+			changes = append(changes, change)
+		}
+	}
+
+	return changes, ids, rows.Err()
+}
+
+// parseChangeKey returns the logged values of table by their column names,
+// converted by the types of the columns: numbers and times are read as
+// such, everything else is kept as text, e.g. '007'
+func (t *DependencyTree) parseChangeKey(table string, key string) map[string]interface{} {
+	cols := t.keyColumns(table)
+	vals := make(map[string]interface{}, len(cols))
+	for i, val := range splitChangeKey(key) {
+		if i >= len(cols) || val == nil {
+			continue
+		}
+
+		vals[cols[i]] = *val
+		switch columnKind(t.Prepared.Types[table][cols[i]]) {
+		case "number":
+			if n, err := strconv.ParseInt(*val, 10, 64); err == nil {
+				vals[cols[i]] = n
+			} else if f, err := strconv.ParseFloat(*val, 64); err == nil {
+				vals[cols[i]] = f
+			}
+		case "date", "timestamp":
+			if at, err := time.Parse(changeTimeLayout, *val); err == nil {
+				vals[cols[i]] = at
+			}
+		}
+	}
+
+	return vals
+}
+
+// splitChangeKey splits a logged key into its values, unescaped,
+// nil for nulls
+func splitChangeKey(key string) []*string {
+	var vals []*string
+	var val bytes.Buffer
+	null := false
+	end := func() {
+		if null {
+			vals = append(vals, nil)
+		} else {
+			str := val.String()
+			vals = append(vals, &str)
+		}
+		val.Reset()
+		null = false
+	}
+
+	for i := 0; i < len(key); i++ {
+		switch {
+		case strings.HasPrefix(key[i:], changeKeyNull):
+			null = true
+			i += len(changeKeyNull) - 1
+		case strings.HasPrefix(key[i:], changeKeyEscape) && i+len(changeKeyEscape) < len(key):
+			i += len(changeKeyEscape)
+			val.WriteByte(key[i])
+		case strings.HasPrefix(key[i:], changeKeySep):
+			end()
+			i += len(changeKeySep) - 1
+		default:
+			val.WriteByte(key[i])
+		}
+	}
+	end()
+
+	return vals
+}
+
+// columnKind tells how values of a column of the database type dataType
+// are logged and read back: as a "number", a "date", a "timestamp"
+// or, for any other type, as "text"
+func columnKind(dataType string) string {
+	dataType = strings.ToUpper(dataType)
+	switch {
+	case strings.HasPrefix(dataType, "TIMESTAMP"), strings.HasPrefix(dataType, "DATETIME"):
+		return "timestamp"
+	case dataType == "DATE":
+		return "date"
+	case strings.HasPrefix(dataType, "INTERVAL"):
+		return "text"
+	}
+
+	for _, number := range []string{"NUMBER", "NUMERIC", "DEC", "INT", "BIGINT", "SMALLINT", "TINYINT", "FLOAT", "REAL", "DOUBLE", "BINARY_"} {
+		if strings.HasPrefix(dataType, number) {
+			return "number"
+		}
+	}
+	return "text"
+}
+
+// changeTarget is where rows of a table show up in the documents of root,
+// the documents hold a row when Cols of the table at Path
+// equal the logged KeyCols of the row.
+// Rows held by the elements of an NxN or array table are found through
+// Inner, the target of the elements: the documents then hold the row
+// when Cols equal KeyCols of the elements holding it.
+type changeTarget struct {
+	Root    *TableNode
+	Path    string
+	Cols    []string
+	KeyCols []string
+	IsRoot  bool
+	Inner   *changeTarget
+}
+
+// changeTargets returns every place where rows of changed show up
+// below node, which is at path in the documents of root
+func (t *DependencyTree) changeTargets(root, node *TableNode, path, changed string) []changeTarget {
+	var targets []changeTarget
+	if node == root && node.Name == changed {
+		pks := t.Prepared.PKs[changed]
+		targets = append(targets, changeTarget{Root: root, Path: path, Cols: pks, KeyCols: pks, IsRoot: true})
+	}
+
+	for _, embedded := range node.Embedded {
+		if embedded.Name == changed {
+			fk := t.Prepared.FKs[node.Name][changed]
+			targets = append(targets, changeTarget{Root: root, Path: path, Cols: fk.Columns, KeyCols: fk.ForeignColumns})
+		}
+		targets = append(targets, t.changeTargets(root, embedded, path+"."+embedded.Name, changed)...)
+	}
+
+	// references written with more than the key change along with the row
+	for _, referenced := range node.Referenced {
+		if referenced == changed && len(removeDuplicate(t.referenceColumns(changed), t.Prepared.PKs[changed])) > 0 {
+			fk := t.Prepared.FKs[node.Name][changed]
+			targets = append(targets, changeTarget{Root: root, Path: path, Cols: fk.Columns, KeyCols: fk.ForeignColumns})
+		}
+	}
+
+	// rows of array tables and subtypes relate to node as the ones of NxN tables do
+	elements := append(append([]*TableNode(nil), node.NxNProxy...), node.Arrays...)
+	related := append(append([]*TableNode(nil), elements...), node.Subtypes...)
+	for _, nxn := range related {
+		if nxn.Name == changed {
+			fk := t.Prepared.FKs[changed][node.Name]
+			targets = append(targets, changeTarget{Root: root, Path: path, Cols: fk.ForeignColumns, KeyCols: fk.Columns})
+		}
+	}
+
+	// and so do the elements holding rows of changed, found first
+	for _, nxn := range elements {
+		fk := t.Prepared.FKs[nxn.Name][node.Name]
+		for _, inner := range t.changeTargets(nxn, nxn, nxn.Name, changed) {
+			if !inner.IsRoot {
+				inner := inner
+				targets = append(targets, changeTarget{Root: root, Path: path, Cols: fk.ForeignColumns, KeyCols: fk.Columns, Inner: &inner})
+			}
+		}
+	}
+
+	for _, subtype := range node.Subtypes {
+		targets = append(targets, t.changeTargets(root, subtype, path+"."+subtype.Name, changed)...)
+	}
+
+	return targets
+}
+
+// writeChangedDocuments writes the replacement of every document of target
+// holding the changed row, or the deletion of the document whose root
+// row it was
+func (t *DependencyTree) writeChangedDocuments(buf *bytes.Buffer, db Querier, target changeTarget, vals map[string]interface{}, written map[string]bool) error {
+	root := target.Root
+	keys, err := t.targetKeys(db, target, vals)
+	if err != nil || len(keys) == 0 {
+		return err
+	}
+
+	found := false
+	for _, batch := range keyBatches(keys) {
+		b := t.selectAll(root, nil)
+		b.WhereIn(b.paths[target.Path], target.Cols, batch)
+		err := t.eachDocument(db, root, b, func(doc, filter string) {
+			found = true
+			if written[root.Name+filter] {
+				return
+			}
+			written[root.Name+filter] = true
+
+			buf.WriteString("db." + t.CollectionName(root.Name) + ".replaceOne(")
+			buf.WriteString(filter)
+			buf.WriteString(", ")
+			buf.WriteString(doc)
+			buf.WriteString(", {upsert: true})\n")
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if !found && target.IsRoot {
+		buf.WriteString("db." + t.CollectionName(root.Name) + ".deleteOne(")
+		buf.WriteString(t.idFilter(root, vals))
+		buf.WriteString(")\n")
+	}
+
+	return nil
+}
+
+// targetKeys returns the values of target's Cols of the rows holding the
+// changed row whose logged key is vals: its KeyCols, or else the KeyCols of
+// the elements Inner finds, once each. Incomplete keys relate to nothing.
+func (t *DependencyTree) targetKeys(db Querier, target changeTarget, vals map[string]interface{}) ([][]interface{}, error) {
+	if target.Inner == nil {
+		key := make([]interface{}, len(target.KeyCols))
+		for i, col := range target.KeyCols {
+			if key[i] = vals[col]; key[i] == nil {
+				return nil, nil
+			}
+		}
+		return [][]interface{}{key}, nil
+	}
+
+	inner := *target.Inner
+	innerKeys, err := t.targetKeys(db, inner, vals)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys [][]interface{}
+	seen := make(map[string]bool)
+	for _, batch := range keyBatches(innerKeys) {
+		b := t.selectAll(inner.Root, nil)
+		b.WhereIn(b.paths[inner.Path], inner.Cols, batch)
+		rows, err := b.Query().All(db)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, row := range rows {
+			key := make([]interface{}, len(target.KeyCols))
+			complete := true
+			for i, col := range target.KeyCols {
+				key[i] = row[inner.Root.Name+"."+col]
+				complete = complete && key[i] != nil
+			}
+			if k := lookupKey(key); complete && !seen[k] {
+				seen[k] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	return keys, nil
+}
+
+// idFilter returns the filter matching the document of root by the
+// logged key of its row, on the dotted names of the _id fields,
+// as the row itself may be gone
+func (t *DependencyTree) idFilter(root *TableNode, vals map[string]interface{}) string {
+	// lay the values out as if the row had been queried
+	m := make(map[string]interface{})
+	for col, val := range vals {
+		m[root.Name+"."+col] = val
+	}
+	for foreign, fk := range t.Prepared.FKs[root.Name] {
+		for i, col := range fk.Columns {
+			m[root.Name+"."+foreign+"."+fk.ForeignColumns[i]] = vals[col]
+		}
+	}
+
+	var buf bytes.Buffer
+	sep := ""
+	id := t.prepareColumns(nil, root, root.Name, false)[0]
+	t.writeDottedFields(&buf, &sep, id, "", m)
+
+	return "{" + buf.String() + "}"
+}
+
+// writeDottedFields writes each value of c found in m as "dotted.name": value
+func (t *DependencyTree) writeDottedFields(buf *bytes.Buffer, sep *string, c *BsonColumn, prefix string, m map[string]interface{}) {
+	name := prefix + c.Field
+	if c.IsArray {
+		return
+	}
+
+	if len(c.InnerColumns) > 0 {
+		// variants are flattened into the document
+		innerPrefix := name + "."
+		if c.variant != "" {
+			innerPrefix = prefix
+		}
+		for _, inner := range c.InnerColumns {
+			t.writeDottedFields(buf, sep, inner, innerPrefix, m)
+		}
+		return
+	}
+
+	if value := t.columnValue(c, m); value != nil {
+		if valueStr := valueString(value); valueStr != "" {
+			buf.WriteString(*sep)
+			buf.WriteString("\"" + name + "\": " + valueStr)
+			*sep = ", "
+		}
+	}
+}
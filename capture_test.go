@@ -0,0 +1,211 @@
+package mongifylab_test
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestChangePoller(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	script, err := tree.CreateChangeLogScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(script); err != nil {
+		t.Fatal(err, script)
+	}
+
+	_, err = sqlite.Exec(`
+	UPDATE ESTADO SET NOME = 'São Paulo' WHERE SIGLA = 'SP';
+	INSERT INTO SOCIO VALUES (1, 1);
+	DELETE FROM PESSOA WHERE ID = 2;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	poller := &mongifylab.ChangePoller{Tree: tree}
+	updates, lastID, err := poller.Poll(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`db.PESSOA.replaceOne({_id: {ID: 1}}, {_id: {ID: 1}, NOME: "Ana", CIDADE: {ID: 1, NOME: "Campinas", ESTADO: {SIGLA: "SP", NOME: "São Paulo"}}}, {upsert: true})`,
+		`db.CLUBE.replaceOne({_id: {ID: 1}}, {_id: {ID: 1}, NOME: "Xadrez", `,
+		`db.PESSOA.deleteOne({"_id.ID": 2})`,
+	}
+	for _, update := range expected {
+		if !strings.Contains(updates, update) {
+			t.Errorf("missing %s in:\n%s", update, updates)
+		}
+	}
+
+	poller.LastID = lastID
+	if updates, _, err := poller.Poll(sqlite); err != nil || updates != "" {
+		t.Error("changes were polled twice:", updates, err)
+	}
+}
+
+func TestChangePollerLateCommits(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	script, err := tree.CreateChangeLogScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(script); err != nil {
+		t.Fatal(err, script)
+	}
+
+	// changes logged under ids taken ahead of an earlier one
+	_, err = sqlite.Exec(`
+	UPDATE PESSOA SET NOME = 'Ana Maria' WHERE ID = 1;
+	UPDATE MONGIFY_CHANGES SET ID = ID + 100;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller := &mongifylab.ChangePoller{Tree: tree}
+	_, lastID, err := poller.Poll(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	poller.LastID = lastID
+
+	// the earlier one commits once they were polled
+	if _, err := sqlite.Exec(`UPDATE PESSOA SET NOME = 'Bea' WHERE ID = 2`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(`UPDATE MONGIFY_CHANGES SET ID = ID - 60 WHERE ID > ?`, lastID); err != nil {
+		t.Fatal(err)
+	}
+	updates, lastID, err := poller.Poll(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(updates, `NOME: "Bea"`) || strings.Contains(updates, `NOME: "Ana Maria"`) {
+		t.Error("expected only the late change in:", updates)
+	}
+	if lastID != poller.LastID {
+		t.Error("late changes moved LastID back to", lastID)
+	}
+
+	poller.LastID = lastID
+	if updates, _, err := poller.Poll(sqlite); err != nil || updates != "" {
+		t.Error("late changes were polled twice:", updates, err)
+	}
+
+	// a new poller reads its window again, missing changes further behind
+	late := &mongifylab.ChangePoller{Tree: tree, LastID: lastID, Window: 10}
+	updates, _, err = late.Poll(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(updates, `NOME: "Ana Maria"`) || strings.Contains(updates, `NOME: "Bea"`) {
+		t.Error("expected only the changes of the window in:", updates)
+	}
+}
+
+// pollAfter creates the change log of tree, runs changes and polls them
+func pollAfter(t *testing.T, sqlite *sql.DB, tree *mongifylab.DependencyTree, changes string) string {
+	script, err := tree.CreateChangeLogScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(script); err != nil {
+		t.Fatal(err, script)
+	}
+	if _, err := sqlite.Exec(changes); err != nil {
+		t.Fatal(err)
+	}
+
+	updates, _, err := (&mongifylab.ChangePoller{Tree: tree}).Poll(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return updates
+}
+
+func TestChangePollerKeys(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	// text keys holding the separator and leading zeros
+	_, err := sqlite.Exec(`
+	INSERT INTO ESTADO VALUES ('0|7', 'Zero');
+	INSERT INTO CIDADE VALUES (7, 'Zerolandia', '0|7');
+	INSERT INTO PESSOA VALUES (7, 'Zeca', 7);
+	INSERT INTO ESTADO VALUES ('007', 'Agente');
+	INSERT INTO CIDADE VALUES (8, 'Londres', '007');
+	INSERT INTO PESSOA VALUES (8, 'James', 8);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	updates := pollAfter(t, sqlite, tree, `
+	UPDATE ESTADO SET NOME = 'Sete' WHERE SIGLA = '0|7';
+	UPDATE ESTADO SET NOME = 'Bond' WHERE SIGLA = '007';`)
+	for _, expected := range []string{
+		`db.PESSOA.replaceOne({_id: {ID: 7}}, {_id: {ID: 7}, NOME: "Zeca", CIDADE: {ID: 7, NOME: "Zerolandia", ESTADO: {SIGLA: "0|7", NOME: "Sete"}}}, {upsert: true})`,
+		`db.PESSOA.replaceOne({_id: {ID: 8}}, {_id: {ID: 8}, NOME: "James", CIDADE: {ID: 8, NOME: "Londres", ESTADO: {SIGLA: "007", NOME: "Bond"}}}, {upsert: true})`,
+	} {
+		if !strings.Contains(updates, expected) {
+			t.Errorf("missing %s in:\n%s", expected, updates)
+		}
+	}
+	if strings.Contains(updates, "{ID: 1}") {
+		t.Error("unchanged documents were replaced:", updates)
+	}
+}
+
+func TestChangePollerReferencesAndSubtypes(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "CANDIDATO")
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`INSERT INTO CANDIDATO VALUES (1, 13)`); err != nil {
+		t.Fatal(err)
+	}
+	tree.Add("CANDIDATO", mongifylab.SubtypeTransform)
+	tree.SetMode("CIDADE", mongifylab.ReferencedTransform)
+	tree.SetExtendedReference("CIDADE", []string{"NOME"})
+
+	updates := pollAfter(t, sqlite, tree, `
+	UPDATE CIDADE SET NOME = 'Campinas do Mato Dentro' WHERE ID = 1;
+	UPDATE CANDIDATO SET NUMERO = 45 WHERE ID = 1;`)
+	for _, expected := range []string{
+		`db.PESSOA.replaceOne({_id: {ID: 1}}, {_id: {ID: 1}, _type: "CANDIDATO", NOME: "Ana", CIDADE: {ID: 1, NOME: "Campinas do Mato Dentro"}, NUMERO: 45}, {upsert: true})`,
+		`db.PESSOA.replaceOne({_id: {ID: 2}}, {_id: {ID: 2}, _type: "PESSOA", NOME: "Bia", CIDADE: {ID: 1, NOME: "Campinas do Mato Dentro"}}, {upsert: true})`,
+	} {
+		if !strings.Contains(updates, expected) {
+			t.Errorf("missing %s in:\n%s", expected, updates)
+		}
+	}
+}
+
+func TestChangeLogFormats(t *testing.T) {
+	tree := &mongifylab.DependencyTree{Dialect: mongifylab.Oracle, NxN: make(map[string]*mongifylab.TableNode)}
+	tree.Prepared.Tables = []string{"VOTO"}
+	tree.Prepared.Cols = map[string][]string{"VOTO": {"DIA", "URNA", "SECAO"}}
+	tree.Prepared.PKs = map[string][]string{"VOTO": {"DIA", "URNA", "SECAO"}}
+	tree.Prepared.Types = map[string]map[string]string{"VOTO": {"DIA": "DATE", "URNA": "NUMBER", "SECAO": "VARCHAR2"}}
+	tree.Add("VOTO", mongifylab.SimpleTransform)
+
+	script, err := tree.CreateChangeLogScript()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`COALESCE(REPLACE(REPLACE(TO_CHAR(:NEW."DIA", 'YYYY-MM-DD"T"HH24:MI:SS'), '\', '\\'), '|', '\|'), '\N')`,
+		`TO_CHAR(:NEW."URNA", 'TM9', 'NLS_NUMERIC_CHARACTERS=''.,''')`,
+		`TO_CHAR(:NEW."SECAO")`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+}
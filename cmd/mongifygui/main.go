@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"database/sql"
+	"fmt"
 
 	"log"
 
@@ -9,6 +11,8 @@ import (
 
 	"io/ioutil"
 
+	"strconv"
+
 	"github.com/google/gxui"
 	"github.com/google/gxui/drivers/gl"
 	"github.com/google/gxui/gxfont"
@@ -28,6 +32,16 @@ var labelFont gxui.Font
 var tree gxui.Tree
 var list gxui.DropDownList
 var table gxui.TableLayout
+var where, sample, changedBy, orderBy, maxItems gxui.TextBox
+
+// mappingFile is where the mapping is loaded from and saved to
+const mappingFile = "mapping.json"
+
+// stateFile keeps the high-water marks from one delta to the next
+const stateFile = "state.json"
+
+// pendingState holds the marks of the last delta until it is applied
+var pendingState *mongifylab.State
 
 var db *sql.DB
 var dependencies *mongifylab.DependencyTree
@@ -74,20 +88,62 @@ func application(driver gxui.Driver) {
 }
 
 func addDependency(table string, mode mongifylab.TransformMode) {
+	// tables already added just change their mode
 	dependencies.Add(table, mode)
 
-	// remove from list
-	listAdapter := list.Adapter().(*gxui.DefaultAdapter)
-	selID := listAdapter.ItemIndex(list.Selected())
-	listItems := listAdapter.Items().([]string)
-	listItems = append(listItems[:selID], listItems[selID+1:]...)
-	listAdapter.SetItems(listItems)
-	listAdapter.DataReplaced()
-	if len(listItems) > 0 {
-		list.Select(0)
+	// filter rows, if asked to
+	var percent float64
+	if text := sample.Text(); text != "" {
+		var err error
+		percent, err = strconv.ParseFloat(text, 64)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+	dependencies.SetFilter(table, where.Text(), percent)
+	where.SetText("")
+	sample.SetText("")
+
+	// order and limit arrays, if asked to
+	if mode == mongifylab.ArrayTransform {
+		var max int
+		if text := maxItems.Text(); text != "" {
+			var err error
+			max, err = strconv.Atoi(text)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+		dependencies.SetArrayOptions(table, orderBy.Text(), max)
+		orderBy.SetText("")
+		maxItems.SetText("")
+	}
+
+	// track changes, if asked to
+	if column := changedBy.Text(); column != "" {
+		dependencies.SetChangeTracking(table, column, nil)
+		changedBy.SetText("")
+	}
+
+	remakeTree()
+}
+
+// validate returns the issues of the mapping as script comments,
+// ok is false if scripts must not be generated
+func validate() (issues string, ok bool) {
+	var buf bytes.Buffer
+	found := dependencies.Validate()
+	for _, issue := range found {
+		buf.WriteString("/* " + issue.String() + " */\n")
+	}
+	if len(found) > 0 {
+		buf.WriteString("\n")
 	}
 
-	// add to tree
+	return buf.String(), !mongifylab.HasErrors(found)
+}
+
+func remakeTree() {
 	treeAdapter := tree.Adapter().(*TableNodeAdapter)
 	treeAdapter.RemakeFromDependencies(dependencies)
 	tree.ExpandAll()
@@ -115,10 +171,50 @@ func newPanelHolder(theme gxui.Theme, driver gxui.Driver) gxui.PanelHolder {
 	list.SetBubbleOverlay(overlays[0])
 	list.SetMargin(math.CreateSpacing(5))
 
+	whereLabel := theme.CreateLabel()
+	whereLabel.SetText("Where:")
+
+	where = theme.CreateTextBox()
+	where.SetSize(math.Size{W: math.MaxSize.W, H: 20})
+
+	changedByLabel := theme.CreateLabel()
+	changedByLabel.SetText("Changed by:")
+
+	changedBy = theme.CreateTextBox()
+	changedBy.SetSize(math.Size{W: math.MaxSize.W, H: 20})
+
+	sampleLabel := theme.CreateLabel()
+	sampleLabel.SetText("Sample %:")
+
+	sample = theme.CreateTextBox()
+	sample.SetSize(math.Size{W: math.MaxSize.W, H: 20})
+
+	orderByLabel := theme.CreateLabel()
+	orderByLabel.SetText("Order by:")
+
+	orderBy = theme.CreateTextBox()
+	orderBy.SetSize(math.Size{W: math.MaxSize.W, H: 20})
+
+	maxItemsLabel := theme.CreateLabel()
+	maxItemsLabel.SetText("Max items:")
+
+	maxItems = theme.CreateTextBox()
+	maxItems.SetSize(math.Size{W: math.MaxSize.W, H: 20})
+
 	table = theme.CreateTableLayout()
-	table.SetGrid(17, 20)
-	table.SetChildAt(0, 0, 2, 2, listLabel)
-	table.SetChildAt(2, 0, 15, 2, list)
+	table.SetGrid(19, 21)
+	table.SetChildAt(0, 0, 2, 1, listLabel)
+	table.SetChildAt(2, 0, 17, 1, list)
+	table.SetChildAt(0, 1, 2, 1, whereLabel)
+	table.SetChildAt(2, 1, 8, 1, where)
+	table.SetChildAt(10, 1, 2, 1, changedByLabel)
+	table.SetChildAt(12, 1, 3, 1, changedBy)
+	table.SetChildAt(15, 1, 2, 1, sampleLabel)
+	table.SetChildAt(17, 1, 2, 1, sample)
+	table.SetChildAt(0, 2, 2, 1, orderByLabel)
+	table.SetChildAt(2, 2, 13, 1, orderBy)
+	table.SetChildAt(15, 2, 2, 1, maxItemsLabel)
+	table.SetChildAt(17, 2, 2, 1, maxItems)
 
 	addSimple := theme.CreateButton()
 	addSimple.SetText("Simple")
@@ -147,6 +243,15 @@ func newPanelHolder(theme gxui.Theme, driver gxui.Driver) gxui.PanelHolder {
 		}
 	})
 
+	addArray := theme.CreateButton()
+	addArray.SetText("Array")
+	addArray.SetHorizontalAlignment(gxui.AlignCenter)
+	addArray.OnClick(func(gxui.MouseEvent) {
+		if selected := list.Selected(); selected != nil {
+			addDependency(selected.(string), mongifylab.ArrayTransform)
+		}
+	})
+
 	addNxN := theme.CreateButton()
 	addNxN.SetText("N x N")
 	addNxN.SetHorizontalAlignment(gxui.AlignCenter)
@@ -159,40 +264,45 @@ func newPanelHolder(theme gxui.Theme, driver gxui.Driver) gxui.PanelHolder {
 	// forward declaration
 	var code gxui.CodeEditor
 
-	// reset := theme.CreateButton()
-	// reset.SetText("Reset")
-	// reset.SetHorizontalAlignment(gxui.AlignCenter)
-	// reset.OnClick(func(gxui.MouseEvent) {
-	// 	dependencies.Clear()
-	// 	tree.Adapter().(*TableNodeAdapter).RemakeFromDependencies(dependencies)
-	// 	var tables []string
-	// 	copy(tables, dependencies.Prepared.Tables)
-	// 	list.Adapter().(*gxui.DefaultAdapter).SetItems(tables)
-	// 	list.Adapter().(*gxui.DefaultAdapter).DataReplaced()
-	// 	code.SetText("")
-	// })
+	remove := theme.CreateButton()
+	remove.SetText("Remove")
+	remove.SetHorizontalAlignment(gxui.AlignCenter)
+	remove.OnClick(func(gxui.MouseEvent) {
+		if selected := list.Selected(); selected != nil {
+			dependencies.Remove(selected.(string))
+			remakeTree()
+		}
+	})
+
+	reset := theme.CreateButton()
+	reset.SetText("Reset")
+	reset.SetHorizontalAlignment(gxui.AlignCenter)
+	reset.OnClick(func(gxui.MouseEvent) {
+		dependencies.Reset()
+		remakeTree()
+		code.SetText("")
+	})
 
 	recommended := theme.CreateButton()
-	recommended.SetText("Premade")
+	recommended.SetText("Recommend")
 	recommended.SetHorizontalAlignment(gxui.AlignCenter)
 	recommended.OnClick(func(gxui.MouseEvent) {
-		dependencies.Clear()
-		dependencies.Add("LE01ESTADO", mongifylab.EmbeddedTransform)
-		dependencies.Add("LE02CIDADE", mongifylab.ReferencedTransform)
-		dependencies.Add("LE03ZONA", mongifylab.ReferencedTransform)
-		dependencies.Add("LE04BAIRRO", mongifylab.ReferencedTransform)
-		dependencies.Add("LE05URNA", mongifylab.ReferencedTransform)
-		dependencies.Add("LE06SESSAO", mongifylab.ReferencedTransform)
-		dependencies.Add("LE07PARTIDO", mongifylab.EmbeddedTransform)
-		dependencies.Add("LE09CARGO", mongifylab.ReferencedTransform)
-		dependencies.Add("LE10CANDIDATURA", mongifylab.NxNTransform)
-		dependencies.Add("LE08CANDIDATO", mongifylab.ReferencedTransform)
-		dependencies.Add("LE11PLEITO", mongifylab.ReferencedTransform)
-		dependencies.Add("LE12PESQUISA", mongifylab.ReferencedTransform)
-		dependencies.Add("LE13INTENCAODEVOTO", mongifylab.ReferencedTransform)
-		treeAdapter := tree.Adapter().(*TableNodeAdapter)
-		treeAdapter.RemakeFromDependencies(dependencies)
-		tree.ExpandAll()
+		recommendations, err := dependencies.Recommend(db)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		// start from the recommended modes, explaining each one
+		modes := make(map[string]mongifylab.TransformMode)
+		var reasons bytes.Buffer
+		for _, recommendation := range recommendations {
+			modes[recommendation.Table] = recommendation.Mode
+			fmt.Fprintf(&reasons, "/* %s: %v, %s */\n", recommendation.Table, recommendation.Mode, recommendation.Reason)
+		}
+		dependencies.Resolve(modes)
+		remakeTree()
+		code.SetText(reasons.String())
 	})
 
 	submit := theme.CreateButton()
@@ -200,22 +310,122 @@ func newPanelHolder(theme gxui.Theme, driver gxui.Driver) gxui.PanelHolder {
 	submit.SetHorizontalAlignment(gxui.AlignCenter)
 	// submit.SetBorderPen(gxui.WhitePen)
 	submit.OnClick(func(gxui.MouseEvent) {
+		issues, ok := validate()
+		if !ok {
+			code.SetText(issues)
+			return
+		}
+
 		insert, err := dependencies.CreateCollectionScript(db)
 		if err != nil {
 			log.Println(err)
 			return
 		}
 		index := dependencies.CreateIndexScript()
-		code.SetText(insert + "\n/* Indexes */\n" + index)
+		validators, err := dependencies.CreateValidatorScript(db)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		code.SetText(issues + insert + "\n/* Indexes */\n" + index + "\n/* Validators */\n" + validators)
+	})
+
+	delta := theme.CreateButton()
+	delta.SetText("Delta")
+	delta.SetHorizontalAlignment(gxui.AlignCenter)
+	delta.OnClick(func(gxui.MouseEvent) {
+		issues, ok := validate()
+		if !ok {
+			code.SetText(issues)
+			return
+		}
+
+		// deltas start from the marks of the last applied one,
+		// not from the ones of a delta that was only generated
+		pendingState = nil
+		if file, err := os.Open(stateFile); err == nil {
+			err = dependencies.LoadState(file)
+			file.Close()
+			if err != nil {
+				log.Println(err)
+				return
+			}
+		} else if os.IsNotExist(err) {
+			if err := dependencies.SetState(&mongifylab.State{Version: mongifylab.StateVersion}); err != nil {
+				log.Println(err)
+				return
+			}
+		} else {
+			log.Println(err)
+			return
+		}
+
+		script, err := dependencies.CreateDeltaScript(db)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		pendingState, err = dependencies.State()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		code.SetText(issues + script + "\n/* Press Applied once the script has run */\n")
 	})
 
-	table.SetChildAt(2, 2, 2, 1, addSimple)
-	table.SetChildAt(4, 2, 2, 1, addReferenced)
-	table.SetChildAt(6, 2, 2, 1, addEmbedded)
-	table.SetChildAt(8, 2, 2, 1, addNxN)
-	// table.SetChildAt(11, 2, 2, 1, reset)
-	table.SetChildAt(13, 2, 2, 1, recommended)
-	table.SetChildAt(15, 2, 2, 1, submit)
+	applied := theme.CreateButton()
+	applied.SetText("Applied")
+	applied.SetHorizontalAlignment(gxui.AlignCenter)
+	applied.OnClick(func(gxui.MouseEvent) {
+		if pendingState == nil {
+			log.Println("no delta waiting to be applied")
+			return
+		}
+		if err := dependencies.SetState(pendingState); err != nil {
+			log.Println(err)
+			return
+		}
+
+		file, err := os.Create(stateFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer file.Close()
+		if err := dependencies.SaveState(file); err != nil {
+			log.Println(err)
+			return
+		}
+		pendingState = nil
+	})
+
+	triggers := theme.CreateButton()
+	triggers.SetText("Triggers")
+	triggers.SetHorizontalAlignment(gxui.AlignCenter)
+	triggers.OnClick(func(gxui.MouseEvent) {
+		issues, ok := validate()
+		if !ok {
+			code.SetText(issues)
+			return
+		}
+
+		script, err := dependencies.CreateChangeLogScript()
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		code.SetText(issues + script)
+	})
+
+	table.SetChildAt(0, 3, 2, 1, addSimple)
+	table.SetChildAt(2, 3, 2, 1, addReferenced)
+	table.SetChildAt(4, 3, 2, 1, addEmbedded)
+	table.SetChildAt(6, 3, 2, 1, addArray)
+	table.SetChildAt(8, 3, 2, 1, addNxN)
+	table.SetChildAt(10, 3, 2, 1, remove)
+	table.SetChildAt(12, 3, 2, 1, reset)
+	table.SetChildAt(14, 3, 2, 1, recommended)
+	table.SetChildAt(16, 3, 2, 1, submit)
 
 	//
 	// Code
@@ -240,10 +450,49 @@ func newPanelHolder(theme gxui.Theme, driver gxui.Driver) gxui.PanelHolder {
 		}
 	})
 
-	table.SetChildAt(2, 3, 15, 17, code)
+	loadMapping := theme.CreateButton()
+	loadMapping.SetText("Load map")
+	loadMapping.SetHorizontalAlignment(gxui.AlignCenter)
+	loadMapping.OnClick(func(e gxui.MouseEvent) {
+		file, err := os.Open(mappingFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer file.Close()
+
+		if err := dependencies.LoadMapping(file); err != nil {
+			log.Println(err)
+			return
+		}
+		remakeTree()
+	})
+
+	saveMapping := theme.CreateButton()
+	saveMapping.SetText("Save map")
+	saveMapping.SetHorizontalAlignment(gxui.AlignCenter)
+	saveMapping.OnClick(func(e gxui.MouseEvent) {
+		file, err := os.Create(mappingFile)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer file.Close()
+
+		if err := dependencies.SaveMapping(file); err != nil {
+			log.Println(err)
+		}
+	})
+
+	table.SetChildAt(2, 4, 17, 17, code)
 	// table.SetChildAt(0, 2, 1, 1, codeLabel)
-	table.SetChildAt(0, 3, 2, 1, copyClip)
-	table.SetChildAt(0, 4, 2, 1, save)
+	table.SetChildAt(0, 4, 2, 1, copyClip)
+	table.SetChildAt(0, 5, 2, 1, save)
+	table.SetChildAt(0, 6, 2, 1, delta)
+	table.SetChildAt(0, 7, 2, 1, applied)
+	table.SetChildAt(0, 8, 2, 1, triggers)
+	table.SetChildAt(0, 9, 2, 1, loadMapping)
+	table.SetChildAt(0, 10, 2, 1, saveMapping)
 
 	panel := theme.CreatePanelHolder()
 	panel.AddPanel(table, "Tables")
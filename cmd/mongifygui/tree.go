@@ -91,8 +91,13 @@ func (a *TableNodeAdapter) RemakeFromDependencies(dp *mongifylab.DependencyTree)
 
 func (a *TableNodeAdapter) addTable(parent *TableNode, table *mongifylab.TableNode, mode mongifylab.TransformMode) {
 	prefix := ""
-	if mode == mongifylab.ReferencedTransform {
+	switch mode {
+	case mongifylab.ReferencedTransform:
 		prefix = "-> "
+	case mongifylab.ArrayTransform:
+		prefix = "[] "
+	case mongifylab.SubtypeTransform:
+		prefix = "(sub) "
 	}
 	node := parent.Add(prefix + table.Name)
 
@@ -105,7 +110,11 @@ func (a *TableNodeAdapter) addTable(parent *TableNode, table *mongifylab.TableNo
 	}
 
 	for _, nxn := range table.NxNProxy {
-		nxnNode := node.Add("(N:N) " + nxn.Name)
+		label := "(N:N) " + nxn.Name
+		if nxn.FarSide != "" {
+			label += " to " + nxn.FarSide
+		}
+		nxnNode := node.Add(label)
 		for _, embedded := range nxn.Embedded {
 			a.addTable(nxnNode, embedded, mongifylab.SimpleTransform)
 		}
@@ -114,4 +123,12 @@ func (a *TableNodeAdapter) addTable(parent *TableNode, table *mongifylab.TableNo
 			nxnNode.Add("-> " + ref)
 		}
 	}
+
+	for _, array := range table.Arrays {
+		a.addTable(node, array, mongifylab.ArrayTransform)
+	}
+
+	for _, subtype := range table.Subtypes {
+		a.addTable(node, subtype, mongifylab.SubtypeTransform)
+	}
 }
@@ -0,0 +1,57 @@
+package mongifylab
+
+// lookupColumn returns the column of table written in place of the
+// references to it, empty if it is not a lookup table
+func (t *DependencyTree) lookupColumn(table string) string {
+	added := t.added(table)
+	if added == nil || added.Mode != LookupTransform {
+		return ""
+	}
+	if added.LookupColumn != "" {
+		return added.LookupColumn
+	}
+
+	if cols := removeDuplicate(t.Prepared.Cols[table], t.Prepared.PKs[table]); len(cols) > 0 {
+		return cols[0]
+	}
+	if cols := t.Prepared.Cols[table]; len(cols) > 0 {
+		return cols[0]
+	}
+	return ""
+}
+
+// lookupEnums queries the values of the lookup column of every lookup table
+// whose values validators allow only, written as in the documents, by table
+func (t *DependencyTree) lookupEnums(db Querier) (map[string][]string, error) {
+	enums := make(map[string][]string)
+	for _, added := range t.AddedTables {
+		table := added.Table.Name
+		col := t.lookupColumn(table)
+		if !added.Enum || col == "" {
+			continue
+		}
+
+		b := newSelect(t.dialect())
+		alias := b.From(table)
+		b.Column(alias, col, col)
+		b.OrderBy(b.Qualified(alias, col))
+		rows, err := b.Query().All(db)
+		if err != nil {
+			return nil, err
+		}
+
+		values := []string{}
+		for _, row := range rows {
+			value := row[col]
+			if value == nil {
+				continue
+			}
+			if str := valueString(value); str != "" && !containsString(values, str) {
+				values = append(values, str)
+			}
+		}
+		enums[table] = values
+	}
+
+	return enums, nil
+}
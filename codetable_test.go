@@ -0,0 +1,55 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestLookupTransform(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`INSERT INTO ESTADO VALUES ('RJ', 'Rio de Janeiro')`); err != nil {
+		t.Fatal(err)
+	}
+	tree.SetMode("ESTADO", mongifylab.LookupTransform)
+	tree.SetLookup("ESTADO", "", true)
+	tree.SetFields("CIDADE", map[string]string{"ESTADO": "estado"})
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{_id: {ID: 1}, NOME: "Ana", CIDADE: {ID: 1, NOME: "Campinas", estado: "Sao Paulo"}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	validator, err := tree.CreateValidatorScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `estado: {enum: ["Rio de Janeiro", "Sao Paulo"]}`
+	if !strings.Contains(validator, expected) {
+		t.Errorf("missing %s in:\n%s", expected, validator)
+	}
+
+	tree.SetLookup("ESTADO", "SIGLA", false)
+	if issues := tree.Validate(); mongifylab.HasErrors(issues) {
+		t.Errorf("unexpected errors %v", issues)
+	}
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `estado: "SP"}`; !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	tree.SetLookup("ESTADO", "REGIAO", false)
+	if issues := tree.Validate(); !mongifylab.HasErrors(issues) {
+		t.Errorf("expected an error looking up an unknown column, got %v", issues)
+	}
+}
@@ -0,0 +1,129 @@
+package mongifylab
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ComputedField is a field added to the documents of a table,
+// computed from each of its rows either by the database or by a Hook
+type ComputedField struct {
+	Field string `json:"field"`
+
+	// Expression is a SQL expression computing the field, naming the
+	// columns of the table in braces, e.g. {NOME} || ' ' || {SOBRENOME}
+	Expression string `json:"expression,omitempty"`
+
+	// Hook is the name of the Hook computing the field, see RegisterHook
+	Hook string `json:"hook,omitempty"`
+
+	// Columns lists the columns the hook reads,
+	// they are extracted even if left out of the documents
+	Columns []string `json:"columns,omitempty"`
+}
+
+// Hook computes the value of a field from a row, by its column names.
+// Values are written as those of the columns, JS ones as they are.
+type Hook func(row map[string]interface{}) interface{}
+
+// JS is a value written to the documents as it is,
+// e.g. {type: "Point", coordinates: [-47.06, -22.9]}
+type JS string
+
+var exprColumn = regexp.MustCompile(`\{(\w+)\}`)
+
+// RegisterHook names a hook computed fields may be computed by,
+// replacing the one registered before by the same name
+func (t *DependencyTree) RegisterHook(name string, hook Hook) {
+	if t.Hooks == nil {
+		t.Hooks = make(map[string]Hook)
+	}
+	t.Hooks[name] = hook
+}
+
+// SetComputed sets the computed fields of an added table,
+// replacing the ones set before
+func (t *DependencyTree) SetComputed(table string, computed []ComputedField) {
+	if added := t.added(table); added != nil {
+		added.Computed = computed
+	}
+}
+
+// computedFields returns the computed fields of table
+func (t *DependencyTree) computedFields(table string) []ComputedField {
+	if added := t.added(table); added != nil {
+		return added.Computed
+	}
+	return nil
+}
+
+// checkComputed tells why a computed field of table may not be computed,
+// nil if it may. Hooks are not looked up, they may be registered later.
+func (t *DependencyTree) checkComputed(table string, computed ComputedField) error {
+	switch {
+	case computed.Field == "":
+		return fmt.Errorf("computed field of %s has no name", table)
+	case containsString(t.Prepared.Cols[table], computed.Field):
+		return fmt.Errorf("computed field %s.%s is named as a column", table, computed.Field)
+	case (computed.Expression == "") == (computed.Hook == ""):
+		return fmt.Errorf("computed field %s.%s needs either an expression or a hook", table, computed.Field)
+	}
+
+	cols := computed.Columns
+	for _, match := range exprColumn.FindAllStringSubmatch(computed.Expression, -1) {
+		cols = append(cols, match[1])
+	}
+	for _, col := range cols {
+		if !containsString(t.Prepared.Cols[table], col) {
+			return fmt.Errorf("computed field %s.%s reads unknown column %s", table, computed.Field, col)
+		}
+	}
+
+	return nil
+}
+
+// selectComputed selects the computed fields of table aliased as alias that
+// are computed by expressions, named PATH.FIELD in the resulting rows
+func (t *DependencyTree) selectComputed(b *selectBuilder, table, alias, path string) {
+	for _, computed := range t.computedFields(table) {
+		if computed.Expression == "" {
+			continue
+		}
+
+		expr := exprColumn.ReplaceAllStringFunc(computed.Expression, func(col string) string {
+			return b.Qualified(alias, col[1:len(col)-1])
+		})
+		b.Expression(expr, path+"."+computed.Field)
+	}
+}
+
+// columnValue returns the value of c in the row m,
+// computing it if c is computed by a hook or is an ObjectId
+func (t *DependencyTree) columnValue(c *BsonColumn, m map[string]interface{}) interface{} {
+	switch {
+	case len(c.variants) > 0:
+		if variant := t.variantOf(c.variants, m); variant != "" {
+			return variant
+		}
+		return c.value
+	case c.value != nil:
+		return c.value
+	case c.objectID:
+		return t.objectID(c, m)
+	case c.hook == "":
+		return m[c.Path+"."+c.Name]
+	}
+
+	hook, found := t.Hooks[c.hook]
+	if !found {
+		return nil
+	}
+
+	row := make(map[string]interface{})
+	for _, col := range t.Prepared.Cols[c.Table] {
+		if value, found := m[c.Path+"."+col]; found {
+			row[col] = value
+		}
+	}
+	return hook(row)
+}
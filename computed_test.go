@@ -0,0 +1,58 @@
+package mongifylab_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestComputedFields(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetProjection("PESSOA", nil, []string{"NOME"})
+	tree.SetComputed("PESSOA", []mongifylab.ComputedField{
+		{Field: "saudacao", Expression: "'Oi, ' || {NOME}"},
+		{Field: "iniciais", Hook: "iniciais", Columns: []string{"NOME"}},
+	})
+	tree.SetComputed("CIDADE", []mongifylab.ComputedField{
+		{Field: "local", Hook: "ponto"},
+	})
+
+	if issues := tree.Validate(); !mongifylab.HasErrors(issues) {
+		t.Errorf("expected errors for hooks not registered, got %v", issues)
+	}
+
+	tree.RegisterHook("iniciais", func(row map[string]interface{}) interface{} {
+		return strings.ToUpper(fmt.Sprint(row["NOME"])[:1])
+	})
+	tree.RegisterHook("ponto", func(row map[string]interface{}) interface{} {
+		return mongifylab.JS(fmt.Sprintf("{type: \"Point\", coordinates: [%v, 0]}", row["ID"]))
+	})
+	if issues := tree.Validate(); mongifylab.HasErrors(issues) {
+		t.Errorf("unexpected errors %v", issues)
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{_id: {ID: 1}, CIDADE: {ID: 1, NOME: "Campinas", ESTADO: {SIGLA: "SP", NOME: "Sao Paulo"}, local: {type: "Point", coordinates: [1, 0]}}, saudacao: "Oi, Ana", iniciais: "A"}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	mapping := tree.Mapping()
+	for _, computed := range []mongifylab.ComputedField{
+		{Field: "NOME", Expression: "{NOME}"},
+		{Field: "nome", Expression: "{IDADE}"},
+		{Field: "nome", Expression: "{NOME}", Hook: "iniciais"},
+	} {
+		mapping.Tables[3].Computed = []mongifylab.ComputedField{computed}
+		if err := tree.SetMapping(mapping); err == nil {
+			t.Errorf("expected an error computing %+v", computed)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package mongifylab
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+)
+
+// SetChangeTracking sets the column of an added table that tells when each
+// of its rows last changed, along with the highest value of it already
+// extracted (nil if the table was never extracted).
+// Rows are taken as changed when their column is above the mark, the highest
+// value seen by the last delta, so its values must grow in the order rows
+// are committed. Times or sequence numbers taken as rows are written may not:
+// a transaction committed after a delta began may hold values below the mark
+// it set, and its rows are never extracted. Validate warns of date and
+// timestamp columns for this reason.
+func (t *DependencyTree) SetChangeTracking(table, column string, mark interface{}) {
+	if added := t.added(table); added != nil {
+		added.ChangeColumn = column
+		added.HighWaterMark = mark
+	}
+}
+
+// CreateDeltaScript returns the script for bringing the collections up to date
+// with the rows changed since the last extraction, by upserting every document
+// that holds a changed row, including the ones embedding it or having it in
+// their NxN arrays, and the buckets and overflow of every changed array row.
+// Collections without any tracked table are left out and deleted rows go
+// unnoticed.
+// On success, the high-water marks of the tracked tables are advanced,
+// they should be kept by SaveState only once the script was applied,
+// lest a script that is never run leave its rows behind.
+// Mappings Validate finds errors in are refused with a *ValidationError.
+func (t *DependencyTree) CreateDeltaScript(db *sql.DB) (string, error) {
+	if err := t.checkValid(); err != nil {
+		return "", err
+	}
+
+	snapshot, err := t.dialect().BeginSnapshot(db)
+	if err != nil {
+		return "", err
+	}
+	defer snapshot.Rollback()
+
+	var buf bytes.Buffer
+	if snapshot.Marker != "" {
+		buf.WriteString("/* Snapshot: " + snapshot.Marker + " */\n")
+	}
+	for _, added := range t.AddedTables {
+		if added.ChangeColumn != "" {
+			buf.WriteString(fmt.Sprintf("/* %s changed since: %v */\n", added.Table.Name, added.HighWaterMark))
+		}
+	}
+
+	for _, table := range t.Root {
+		b, tracked := t.selectChanged(table)
+		if !tracked {
+			continue
+		}
+
+		buf.WriteString("\n/* " + table.Name + " */\n")
+		err := t.eachDocument(snapshot, table, b, func(doc, filter string) {
+			buf.WriteString("db." + t.CollectionName(table.Name) + ".replaceOne(")
+			buf.WriteString(filter)
+			buf.WriteString(", ")
+			buf.WriteString(doc)
+			buf.WriteString(", {upsert: true})\n")
+		})
+		if err != nil {
+			return "", err
+		}
+	}
+
+	// buckets and overflows are written anew for the rows they refer to
+	if err := t.writeChangedSpills(&buf, snapshot); err != nil {
+		return "", err
+	}
+
+	// the new marks are read from the same snapshot as the rows
+	marks := make(map[string]interface{})
+	for _, added := range t.AddedTables {
+		if added.ChangeColumn == "" {
+			continue
+		}
+
+		mark, err := t.queryHighWaterMark(snapshot, added.Table.Name, added.ChangeColumn)
+		if err != nil {
+			return "", err
+		}
+		marks[added.Table.Name] = mark
+	}
+
+	for i := range t.AddedTables {
+		if mark, found := marks[t.AddedTables[i].Table.Name]; found && mark != nil {
+			t.AddedTables[i].HighWaterMark = mark
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// queryHighWaterMark returns the highest value of column in table
+func (t *DependencyTree) queryHighWaterMark(snapshot *Snapshot, table, column string) (interface{}, error) {
+	d := t.dialect()
+	query := "SELECT MAX(" + d.QuoteIdent(column) + ") FROM " + d.QuoteIdent(table)
+
+	var mark interface{}
+	err := snapshot.QueryRow(query).Scan(&mark)
+	return mark, err
+}
+
+// StateVersion is the version of the state file format written by
+// SaveState, files of other versions are refused by LoadState
+const StateVersion = 1
+
+// State is what an extraction leaves for the next one, the high-water mark
+// of each tracked table by its name. It is kept apart from the Mapping, as
+// it changes on every extraction while the mapping is reviewed.
+type State struct {
+	Version int             `json:"version"`
+	Marks   map[string]Mark `json:"marks"`
+}
+
+// Mark is a high-water mark along with the type it was read as,
+// so that it is bound to queries as it was read
+type Mark struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// newMark returns the mark holding val, false if val is of no known type
+func newMark(val interface{}) (Mark, bool) {
+	switch v := val.(type) {
+	case int64:
+		return Mark{"int", strconv.FormatInt(v, 10)}, true
+	case float64:
+		return Mark{"float", strconv.FormatFloat(v, 'g', -1, 64)}, true
+	case time.Time:
+		return Mark{"time", v.Format(time.RFC3339Nano)}, true
+	case string:
+		return Mark{"text", v}, true
+	case []byte:
+		return Mark{"text", string(v)}, true
+	}
+	return Mark{}, false
+}
+
+// value returns the value the mark holds
+func (mark Mark) value() (interface{}, error) {
+	switch mark.Type {
+	case "int":
+		return strconv.ParseInt(mark.Value, 10, 64)
+	case "float":
+		return strconv.ParseFloat(mark.Value, 64)
+	case "time":
+		return time.Parse(time.RFC3339Nano, mark.Value)
+	case "text":
+		return mark.Value, nil
+	}
+	return nil, fmt.Errorf("unknown mark type %q", mark.Type)
+}
+
+// State returns the high-water marks of the tracked tables
+// extracted so far
+func (t *DependencyTree) State() (*State, error) {
+	state := &State{Version: StateVersion, Marks: make(map[string]Mark)}
+	for _, added := range t.AddedTables {
+		if added.ChangeColumn == "" || added.HighWaterMark == nil {
+			continue
+		}
+
+		mark, ok := newMark(added.HighWaterMark)
+		if !ok {
+			return nil, fmt.Errorf("high-water mark of %s is of unknown type %T", added.Table.Name, added.HighWaterMark)
+		}
+		state.Marks[added.Table.Name] = mark
+	}
+
+	return state, nil
+}
+
+// SetState sets the high-water marks of the tracked tables to the ones of
+// state, tables left out of it are taken as never extracted.
+// Nothing is changed if a mark is not of a tracked table.
+func (t *DependencyTree) SetState(state *State) error {
+	if state.Version != StateVersion {
+		return fmt.Errorf("state version %d is not supported, expected %d", state.Version, StateVersion)
+	}
+
+	marks := make(map[string]interface{})
+	for table, mark := range state.Marks {
+		if added := t.added(table); added == nil || added.ChangeColumn == "" {
+			return fmt.Errorf("state has a mark of %s, which is not tracked", table)
+		}
+
+		val, err := mark.value()
+		if err != nil {
+			return fmt.Errorf("state mark of %s: %v", table, err)
+		}
+		marks[table] = val
+	}
+
+	for i := range t.AddedTables {
+		t.AddedTables[i].HighWaterMark = marks[t.AddedTables[i].Table.Name]
+	}
+
+	return nil
+}
+
+// LoadState reads a JSON state file into the tree, see SetState
+func (t *DependencyTree) LoadState(r io.Reader) error {
+	var state State
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return err
+	}
+
+	return t.SetState(&state)
+}
+
+// SaveState writes the tree's state as a JSON state file,
+// to be loaded before the next CreateDeltaScript
+func (t *DependencyTree) SaveState(w io.Writer) error {
+	state, err := t.State()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
@@ -0,0 +1,67 @@
+package mongifylab_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDeltaScript(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "PESSOA.ALTERADO")
+	defer sqlite.Close()
+
+	tree.SetChangeTracking("PESSOA", "ALTERADO", nil)
+
+	delta := func() string {
+		script, err := tree.CreateDeltaScript(sqlite)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return script
+	}
+
+	// never extracted, every row is
+	script := delta()
+	for _, expected := range []string{
+		`/* PESSOA changed since: <nil> */`,
+		`db.PESSOA.replaceOne({_id: {ID: 1}}, {_id: {ID: 1}, NOME: "Ana"`,
+		`db.PESSOA.replaceOne({_id: {ID: 2}}, {_id: {ID: 2}, NOME: "Bia"`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+
+	if script := delta(); strings.Contains(script, "replaceOne") {
+		t.Error("unchanged rows were extracted again:", script)
+	}
+
+	if _, err := sqlite.Exec(`UPDATE PESSOA SET NOME = 'Bea', ALTERADO = 3 WHERE ID = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	// marks outlive the mapping being set again and are kept by the state
+	if err := tree.SetMapping(tree.Mapping()); err != nil {
+		t.Fatal(err)
+	}
+	var state bytes.Buffer
+	if err := tree.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(state.String(), `"PESSOA": {`) || !strings.Contains(state.String(), `"value": "2"`) {
+		t.Error("mark is not saved:", state.String())
+	}
+	tree.SetChangeTracking("PESSOA", "ALTERADO", nil)
+	if err := tree.LoadState(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	script = delta()
+	if !strings.Contains(script, `/* PESSOA changed since: 2 */`) || !strings.Contains(script, `NOME: "Bea"`) || strings.Contains(script, `NOME: "Ana"`) {
+		t.Error("expected only the changed row in:", script)
+	}
+
+	if err := tree.LoadState(strings.NewReader(`{"version": 1, "marks": {"CLUBE": {"type": "int", "value": "1"}}}`)); err == nil {
+		t.Error("expected an error loading the mark of an untracked table")
+	}
+}
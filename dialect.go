@@ -0,0 +1,141 @@
+package mongifylab
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+)
+
+// Dialect holds everything that differs between the database engines
+// we extract from
+type Dialect struct {
+	Name string
+
+	// Quote surrounds identifiers, so reserved words and
+	// case sensitive names may be used
+	Quote string
+
+	// MaxIdentLen is the length of the longest identifier allowed,
+	// longer aliases are shortened. Zero means no limit.
+	MaxIdentLen int
+
+	// Binds is how arguments are written in queries
+	Binds BindStyle
+
+	// TableSample is written after a table to read only a percentage of
+	// its rows, formatted with the percentage
+	TableSample string
+
+	// SampleBeforeAlias tells whether TableSample goes between the table
+	// and its alias, instead of after the alias
+	SampleBeforeAlias bool
+
+	// SamplePredicate does the same as TableSample in a WHERE clause,
+	// for dialects without it
+	SamplePredicate string
+
+	// SnapshotOptions are used to start the extraction transaction,
+	// nil means the driver defaults
+	SnapshotOptions *sql.TxOptions
+
+	// SnapshotBegin is run as the first statement of the extraction
+	// transaction, for engines that need it to pin the snapshot.
+	// SnapshotMarker is read after it, in the same transaction.
+	SnapshotBegin string
+
+	// SnapshotMarker is a query returning a single value that identifies
+	// the snapshot, so it can be recorded along with the generated script
+	SnapshotMarker string
+
+	// SnapshotMarkerFallback is run instead when SnapshotMarker fails,
+	// e.g. for lack of privileges. Only engines whose transactions
+	// outlive a failed statement may have one.
+	SnapshotMarkerFallback string
+}
+
+var (
+	// Oracle reads everything in a read-only transaction, which sees the
+	// database as of the SCN it started on. Reading the SCN needs EXECUTE
+	// on DBMS_FLASHBACK, without it the snapshot is marked by its time.
+	Oracle = &Dialect{
+		Name:                   "oracle",
+		Quote:                  `"`,
+		MaxIdentLen:            30,
+		Binds:                  ColonBinds,
+		TableSample:            " SAMPLE (%g)",
+		SampleBeforeAlias:      true,
+		SnapshotBegin:          "SET TRANSACTION READ ONLY",
+		SnapshotMarker:         "SELECT 'SCN ' || TO_CHAR(DBMS_FLASHBACK.GET_SYSTEM_CHANGE_NUMBER) FROM DUAL",
+		SnapshotMarkerFallback: `SELECT 'time ' || TO_CHAR(SYSTIMESTAMP, 'YYYY-MM-DD"T"HH24:MI:SS.FF6 TZH:TZM') FROM DUAL`,
+	}
+
+	// Postgres reads everything in a repeatable read transaction,
+	// whose exported snapshot id is used as the marker
+	Postgres = &Dialect{
+		Name:            "postgres",
+		Quote:           `"`,
+		MaxIdentLen:     63,
+		Binds:           DollarBinds,
+		TableSample:     " TABLESAMPLE BERNOULLI (%g)",
+		SnapshotOptions: &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true},
+		SnapshotMarker:  "SELECT 'snapshot ' || pg_export_snapshot()",
+	}
+
+	// MySQL reads everything in a transaction started WITH CONSISTENT
+	// SNAPSHOT, which InnoDB takes at once instead of at the first read,
+	// so the executed GTID set read right after marks it. The transaction
+	// begun by the driver is implicitly committed by it, the snapshot is
+	// taken with the session's isolation level, which must be the default
+	// REPEATABLE READ.
+	MySQL = &Dialect{
+		Name:            "mysql",
+		Quote:           "`",
+		MaxIdentLen:     64,
+		Binds:           QuestionBinds,
+		SamplePredicate: "RAND() * 100 < %g",
+		SnapshotBegin:   "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY",
+		SnapshotMarker:  "SELECT CONCAT('gtid ', @@GLOBAL.gtid_executed)",
+	}
+
+	// SQLite transactions are always serializable, there is no marker
+	SQLite = &Dialect{
+		Name:            "sqlite",
+		Quote:           `"`,
+		Binds:           QuestionBinds,
+		SamplePredicate: "ABS(RANDOM() %% 10000) < %g * 100",
+	}
+)
+
+// BindStyle is how a dialect writes arguments in queries
+type BindStyle int
+
+const (
+	// ColonBinds are numbered, as in :1, :2
+	ColonBinds BindStyle = iota
+
+	// DollarBinds are numbered, as in $1, $2
+	DollarBinds
+
+	// QuestionBinds are positional, as in ?, ?
+	QuestionBinds
+)
+
+// QuoteIdent returns the identifier quoted for the dialect
+func (d *Dialect) QuoteIdent(ident string) string {
+	if d.Quote == "" {
+		return ident
+	}
+	return d.Quote + strings.Replace(ident, d.Quote, d.Quote+d.Quote, -1) + d.Quote
+}
+
+// Bind returns the placeholder of the nth argument, counting from 1
+func (d *Dialect) Bind(n int) string {
+	switch d.Binds {
+	case DollarBinds:
+		return "$" + strconv.Itoa(n)
+	case QuestionBinds:
+		return "?"
+	default:
+		return ":" + strconv.Itoa(n)
+	}
+}
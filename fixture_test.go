@@ -0,0 +1,226 @@
+package mongifylab_test
+
+import (
+	"bytes"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/victorMoneratto/mongifylab"
+)
+
+// sqliteTables are the tables tests add to the ones of newSQLiteTree, by
+// name, created empty. Entries named TABLE.COLUMN add a column instead,
+// set to the ID of each row.
+var sqliteTables = map[string]string{
+	"APELIDO":         `CREATE TABLE APELIDO (PESSOA REAL REFERENCES PESSOA, APELIDO TEXT, PRIMARY KEY (PESSOA, APELIDO))`,
+	"ATRIBUTO":        `CREATE TABLE ATRIBUTO (PESSOA INTEGER REFERENCES PESSOA, CHAVE TEXT, VALOR TEXT, PRIMARY KEY (PESSOA, CHAVE))`,
+	"CANDIDATO":       `CREATE TABLE CANDIDATO (ID INTEGER PRIMARY KEY REFERENCES PESSOA, NUMERO INTEGER)`,
+	"CLIENTE":         `CREATE TABLE CLIENTE (ID INTEGER PRIMARY KEY REFERENCES PESSOA, LIMITE INTEGER)`,
+	"ELEITOR":         `CREATE TABLE ELEITOR (ID INTEGER PRIMARY KEY REFERENCES PESSOA, TITULO TEXT)`,
+	"FALA":            `CREATE TABLE FALA (PESSOA INTEGER REFERENCES PESSOA, IDIOMA INTEGER REFERENCES IDIOMA, CIDADE INTEGER REFERENCES CIDADE, PRIMARY KEY (PESSOA, IDIOMA))`,
+	"IDIOMA":          `CREATE TABLE IDIOMA (ID INTEGER PRIMARY KEY, NOME TEXT)`,
+	"IDIOMA.ALTERADO": `ALTER TABLE IDIOMA ADD ALTERADO INTEGER; UPDATE IDIOMA SET ALTERADO = ID`,
+	"PAR":             `CREATE TABLE PAR (A TEXT, B TIMESTAMP, PRIMARY KEY (A, B))`,
+	"PESSOA.ALTERADO": `ALTER TABLE PESSOA ADD ALTERADO INTEGER; UPDATE PESSOA SET ALTERADO = ID`,
+	"VOTO":            `CREATE TABLE VOTO (ID INTEGER PRIMARY KEY, PESSOA INTEGER REFERENCES PESSOA, DATA DATE)`,
+}
+
+// newSQLiteTree returns a tree over a SQLite database of ESTADO, CIDADE,
+// PESSOA, CLUBE and SOCIO, along with the entries of sqliteTables named by
+// tables. The tree is prepared from the schema of the database.
+func newSQLiteTree(t *testing.T, tables ...string) (*sql.DB, *mongifylab.DependencyTree) {
+	return newSQLiteTreeOn(t, "sqlite3", tables...)
+}
+
+// newSQLiteTreeOn is like newSQLiteTree, opening the database by driver
+func newSQLiteTreeOn(t *testing.T, driver string, tables ...string) (*sql.DB, *mongifylab.DependencyTree) {
+	sqlite, err := sql.Open(driver, filepath.Join(t.TempDir(), "capture.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = sqlite.Exec(`
+	CREATE TABLE ESTADO (SIGLA TEXT PRIMARY KEY, NOME TEXT);
+	CREATE TABLE CIDADE (ID INTEGER PRIMARY KEY, NOME TEXT, ESTADO TEXT REFERENCES ESTADO);
+	CREATE TABLE PESSOA (ID INTEGER PRIMARY KEY, NOME TEXT, CIDADE INTEGER REFERENCES CIDADE);
+	CREATE TABLE CLUBE (ID INTEGER PRIMARY KEY, NOME TEXT);
+	CREATE TABLE SOCIO (PESSOA INTEGER REFERENCES PESSOA, CLUBE INTEGER REFERENCES CLUBE, PRIMARY KEY (PESSOA, CLUBE));
+	INSERT INTO ESTADO VALUES ('SP', 'Sao Paulo');
+	INSERT INTO CIDADE VALUES (1, 'Campinas', 'SP');
+	INSERT INTO PESSOA VALUES (1, 'Ana', 1);
+	INSERT INTO PESSOA VALUES (2, 'Bia', 1);
+	INSERT INTO CLUBE VALUES (1, 'Xadrez');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, table := range tables {
+		schema, found := sqliteTables[table]
+		if !found {
+			t.Fatal("no such fixture table:", table)
+		}
+		if _, err := sqlite.Exec(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tree := &mongifylab.DependencyTree{Dialect: mongifylab.SQLite, NxN: make(map[string]*mongifylab.TableNode)}
+	prepareSQLite(t, sqlite, tree)
+
+	tree.Add("ESTADO", mongifylab.EmbeddedTransform)
+	tree.Add("CIDADE", mongifylab.EmbeddedTransform)
+	tree.Add("CLUBE", mongifylab.SimpleTransform)
+	tree.Add("PESSOA", mongifylab.SimpleTransform)
+	tree.Add("SOCIO", mongifylab.NxNTransform)
+
+	return sqlite, tree
+}
+
+// prepareSQLite prepares tree from the tables of sqlite: their columns
+// along with their declared types, primary keys and foreign keys
+func prepareSQLite(t *testing.T, sqlite *sql.DB, tree *mongifylab.DependencyTree) {
+	query := func(stmt string, scan func(rows *sql.Rows) error) {
+		rows, err := sqlite.Query(stmt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			if err := scan(rows); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rows.Err(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prepared := &tree.Prepared
+	prepared.Tables = nil
+	prepared.Cols = make(map[string][]string)
+	prepared.PKs = make(map[string][]string)
+	prepared.Types = make(map[string]map[string]string)
+	prepared.FKs = make(map[string]map[string]mongifylab.FKInfo)
+
+	query(`SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name`, func(rows *sql.Rows) error {
+		var table string
+		err := rows.Scan(&table)
+		prepared.Tables = append(prepared.Tables, table)
+		return err
+	})
+
+	for _, table := range prepared.Tables {
+		pks := make(map[int]string)
+		prepared.Types[table] = make(map[string]string)
+		query(`PRAGMA table_info("`+table+`")`, func(rows *sql.Rows) error {
+			var col, dataType string
+			var cid, notNull, pk int
+			var dflt interface{}
+			err := rows.Scan(&cid, &col, &dataType, &notNull, &dflt, &pk)
+			prepared.Cols[table] = append(prepared.Cols[table], col)
+			prepared.Types[table][col] = dataType
+			if pk > 0 {
+				pks[pk] = col
+			}
+			return err
+		})
+		for i := 1; i <= len(pks); i++ {
+			prepared.PKs[table] = append(prepared.PKs[table], pks[i])
+		}
+	}
+
+	// foreign keys of no columns refer to the primary key
+	for _, table := range prepared.Tables {
+		query(`PRAGMA foreign_key_list("`+table+`")`, func(rows *sql.Rows) error {
+			var id, seq int
+			var foreign, col, onUpdate, onDelete, match string
+			var foreignCol sql.NullString
+			err := rows.Scan(&id, &seq, &foreign, &col, &foreignCol, &onUpdate, &onDelete, &match)
+			if prepared.FKs[table] == nil {
+				prepared.FKs[table] = make(map[string]mongifylab.FKInfo)
+			}
+
+			fk := prepared.FKs[table][foreign]
+			fk.Columns = append(fk.Columns, col)
+			if foreignCol.Valid {
+				fk.ForeignColumns = append(fk.ForeignColumns, foreignCol.String)
+			} else {
+				fk.ForeignColumns = append(fk.ForeignColumns, prepared.PKs[foreign][seq])
+			}
+			prepared.FKs[table][foreign] = fk
+			return err
+		})
+	}
+}
+
+// newElectionTree returns a tree over a schema shaped like the election one
+func newElectionTree() *mongifylab.DependencyTree {
+	fk := func(cols, foreignCols []string) mongifylab.FKInfo {
+		return mongifylab.FKInfo{Columns: cols, ForeignColumns: foreignCols}
+	}
+
+	tree := &mongifylab.DependencyTree{Dialect: mongifylab.SQLite, NxN: make(map[string]*mongifylab.TableNode)}
+	tree.Prepared.Tables = []string{"CANDIDATO", "CANDIDATURA", "CARGO", "CIDADE", "ESTADO", "PARTIDO", "PLEITO"}
+	tree.Prepared.Cols = map[string][]string{
+		"ESTADO":      {"SIGLA", "NOME"},
+		"CIDADE":      {"ID", "NOME", "ESTADO"},
+		"PARTIDO":     {"SIGLA", "NOME", "CIDADE"},
+		"CANDIDATO":   {"ID", "NOME", "PARTIDO", "CIDADE"},
+		"CARGO":       {"ID", "NOME"},
+		"PLEITO":      {"ANO"},
+		"CANDIDATURA": {"CANDIDATO", "CARGO", "PLEITO", "VOTOS"},
+	}
+	tree.Prepared.PKs = map[string][]string{
+		"ESTADO":      {"SIGLA"},
+		"CIDADE":      {"ID"},
+		"PARTIDO":     {"SIGLA"},
+		"CANDIDATO":   {"ID"},
+		"CARGO":       {"ID"},
+		"PLEITO":      {"ANO"},
+		"CANDIDATURA": {"CANDIDATO", "CARGO", "PLEITO"},
+	}
+	tree.Prepared.FKs = map[string]map[string]mongifylab.FKInfo{
+		"CIDADE":  {"ESTADO": fk([]string{"ESTADO"}, []string{"SIGLA"})},
+		"PARTIDO": {"CIDADE": fk([]string{"CIDADE"}, []string{"ID"})},
+		"CANDIDATO": {
+			"PARTIDO": fk([]string{"PARTIDO"}, []string{"SIGLA"}),
+			"CIDADE":  fk([]string{"CIDADE"}, []string{"ID"}),
+		},
+		"CANDIDATURA": {
+			"CANDIDATO": fk([]string{"CANDIDATO"}, []string{"ID"}),
+			"CARGO":     fk([]string{"CARGO"}, []string{"ID"}),
+			"PLEITO":    fk([]string{"PLEITO"}, []string{"ANO"}),
+		},
+	}
+
+	return tree
+}
+
+// shape describes the tree, so trees may be compared
+func shape(tree *mongifylab.DependencyTree) string {
+	var buf bytes.Buffer
+	var write func(node *mongifylab.TableNode, indent string)
+	write = func(node *mongifylab.TableNode, indent string) {
+		buf.WriteString(indent + node.Name + "\n")
+		for _, embedded := range node.Embedded {
+			write(embedded, indent+"\t")
+		}
+		for _, referenced := range node.Referenced {
+			buf.WriteString(indent + "\t-> " + referenced + "\n")
+		}
+		for _, nxn := range node.NxNProxy {
+			buf.WriteString(indent + "\t(N:N " + nxn.FarSide + ")\n")
+			write(nxn, indent+"\t")
+		}
+		for _, array := range node.Arrays {
+			buf.WriteString(indent + "\t[]\n")
+			write(array, indent+"\t")
+		}
+	}
+
+	for _, root := range tree.Root {
+		write(root, "")
+	}
+	return buf.String()
+}
@@ -0,0 +1,168 @@
+package mongifylab
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// lookupBatchSize is how many parent rows have their arrays fetched by a
+// single query, it keeps IN lists below Oracle's limit of 1000 expressions
+const lookupBatchSize = 500
+
+// batches splits rows into batches of at most lookupBatchSize rows
+func batches(rows []map[string]interface{}) [][]map[string]interface{} {
+	var split [][]map[string]interface{}
+	for start := 0; start < len(rows); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		split = append(split, rows[start:end])
+	}
+	return split
+}
+
+// keyBatches splits keys into batches of at most lookupBatchSize keys
+func keyBatches(keys [][]interface{}) [][][]interface{} {
+	var split [][][]interface{}
+	for start := 0; start < len(keys); start += lookupBatchSize {
+		end := start + lookupBatchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		split = append(split, keys[start:end])
+	}
+	return split
+}
+
+// prefetch fetches the rows of every array column for a whole batch of
+// parent rows at once, instead of querying once per parent row
+func (t *DependencyTree) prefetch(db Querier, cols []*BsonColumn, batch []map[string]interface{}) error {
+	for _, c := range cols {
+		if c.IsArray {
+			c.lookup = make(map[string][]map[string]interface{})
+			for _, parents := range batches(batch) {
+				lookup, err := t.lookupArray(db, c, parents)
+				if err != nil {
+					return err
+				}
+				for key, rows := range lookup {
+					c.lookup[key] = rows
+				}
+			}
+
+			// arrays within the elements are fetched for all of them at once
+			if len(c.InnerColumns) > 0 {
+				var elements []map[string]interface{}
+				for _, rows := range c.lookup {
+					elements = append(elements, rows...)
+				}
+				if err := t.prefetch(db, c.InnerColumns, elements); err != nil {
+					return err
+				}
+			}
+		} else if len(c.InnerColumns) > 0 {
+			if err := t.prefetch(db, c.InnerColumns, batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// lookupArray queries the rows of an array column related to any of the
+// parent rows, grouped by the parent key they relate to.
+// Rows are laid out by the column's InnerColumns, named as by QueryForAll.
+func (t *DependencyTree) lookupArray(db Querier, c *BsonColumn, parents []map[string]interface{}) (map[string][]map[string]interface{}, error) {
+	lookup := make(map[string][]map[string]interface{})
+	fk := t.Prepared.FKs[c.Name][c.Table]
+
+	var keys [][]interface{}
+	for _, m := range parents {
+		key, ok := t.arrayKey(c, m)
+		if _, seen := lookup[key]; !ok || seen {
+			continue
+		}
+		lookup[key] = nil
+
+		vals := make([]interface{}, len(fk.ForeignColumns))
+		for i, col := range fk.ForeignColumns {
+			vals[i] = m[c.Path+"."+col]
+		}
+		keys = append(keys, vals)
+	}
+
+	if len(keys) == 0 {
+		return lookup, nil
+	}
+
+	rows, err := t.QueryArray(t.added(c.Name).Table, fk.Columns, keys).All(db)
+	if err != nil {
+		return lookup, err
+	}
+
+	for _, row := range rows {
+		vals := make([]interface{}, len(fk.Columns))
+		for i, col := range fk.Columns {
+			vals[i] = row[c.Name+"."+col]
+		}
+		key := lookupKey(vals)
+		lookup[key] = append(lookup[key], row)
+	}
+
+	return lookup, nil
+}
+
+// arrayKey returns the key of the parent row that an array column relates to,
+// ok is false when the key is incomplete and nothing may relate to it
+func (t *DependencyTree) arrayKey(c *BsonColumn, m map[string]interface{}) (key string, ok bool) {
+	fk := t.Prepared.FKs[c.Name][c.Table]
+	vals := make([]interface{}, len(fk.ForeignColumns))
+	for i, col := range fk.ForeignColumns {
+		vals[i] = m[c.Path+"."+col]
+		if vals[i] == nil {
+			return "", false
+		}
+	}
+
+	return lookupKey(vals), true
+}
+
+// lookupKey flattens key values so they may index a map, each one
+// written by keyPart and prefixed by its length
+func lookupKey(vals []interface{}) string {
+	var buf bytes.Buffer
+	for _, val := range vals {
+		part := keyPart(val)
+		buf.WriteString(strconv.Itoa(len(part)))
+		buf.WriteByte(':')
+		buf.WriteString(part)
+	}
+
+	return buf.String()
+}
+
+// keyPart writes a key value alike whatever type the driver scanned it as,
+// so that the keys of parents and of their array rows match,
+// e.g. 1 and []byte("1")
+func keyPart(val interface{}) string {
+	switch v := val.(type) {
+	case []byte:
+		return string(v)
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,81 @@
+package mongifylab_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestLookupBatches(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	// more clubs than fit a batch, each with the members it would have
+	// if looked up on its own
+	_, err := sqlite.Exec(`
+	WITH RECURSIVE N(ID) AS (SELECT 2 UNION ALL SELECT ID + 1 FROM N WHERE ID < 1201)
+	INSERT INTO CLUBE SELECT ID, 'Clube ' || ID FROM N;
+	INSERT INTO SOCIO SELECT 1, ID FROM CLUBE WHERE ID % 2 = 0;
+	INSERT INTO SOCIO SELECT 2, ID FROM CLUBE WHERE ID % 3 = 0;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each club is written on a line of its own, its members on the next
+	lines := strings.Split(script, "\n")
+	for id := 2; id <= 1201; id++ {
+		club := fmt.Sprintf("\t{_id: {ID: %d}, NOME: \"Clube %d\"", id, id)
+		members := ""
+		for i, line := range lines {
+			if strings.HasPrefix(line, club) && i+1 < len(lines) && strings.Contains(lines[i+1], "SOCIO: [") {
+				members = lines[i+1]
+			}
+		}
+
+		if strings.Contains(members, "PESSOA: 1") != (id%2 == 0) || strings.Contains(members, "PESSOA: 2") != (id%3 == 0) {
+			t.Fatalf("batched members of club %d differ from its own: %q", id, members)
+		}
+	}
+}
+
+func TestLookupKeyTypes(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "APELIDO")
+	defer sqlite.Close()
+
+	// keys scanned as integers on one side and as floats on the other
+	_, err := sqlite.Exec(`
+	INSERT INTO PESSOA VALUES (1000000, 'Caio', 1);
+	INSERT INTO APELIDO VALUES (1000000, 'Caio Jr');`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Add("APELIDO", mongifylab.ArrayTransform)
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `APELIDO: "Caio Jr"}, ]`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`DROP TABLE SOCIO`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.CreateCollectionScript(sqlite); err == nil {
+		t.Error("expected the error looking up the arrays of a dropped table")
+	}
+}
@@ -0,0 +1,301 @@
+package mongifylab
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// MappingVersion is the version of the mapping file format written by
+// SaveMapping, files of other versions are refused by LoadMapping
+const MappingVersion = 1
+
+// Mapping is how the tables of a database are turned into documents,
+// in a form that may be written to a file, reviewed and loaded again.
+// It holds the options of each added table, never the state of an
+// extraction such as high-water marks, see State.
+type Mapping struct {
+	Version       int             `json:"version"`
+	Dialect       string          `json:"dialect,omitempty"`
+	Naming        *Naming         `json:"naming,omitempty"`
+	References    ReferenceFormat `json:"references,omitempty"`
+	Discriminator string          `json:"discriminator,omitempty"`
+	Tables        []TableMapping  `json:"tables"`
+}
+
+// TableMapping is the mapping of a single added table
+type TableMapping struct {
+	Table          string            `json:"table"`
+	Mode           TransformMode     `json:"mode"`
+	Where          string            `json:"where,omitempty"`
+	Sample         float64           `json:"sample,omitempty"`
+	ChangeColumn   string            `json:"changeColumn,omitempty"`
+	Rename         map[string]string `json:"rename,omitempty"`
+	Include        []string          `json:"include,omitempty"`
+	Exclude        []string          `json:"exclude,omitempty"`
+	OrderBy        string            `json:"orderBy,omitempty"`
+	MaxItems       int               `json:"maxItems,omitempty"`
+	Parent         string            `json:"parent,omitempty"`
+	FarSide        string            `json:"farSide,omitempty"`
+	FarMode        TransformMode     `json:"farMode,omitempty"`
+	Naming         *Naming           `json:"naming,omitempty"`
+	Collection     string            `json:"collection,omitempty"`
+	Computed       []ComputedField   `json:"computed,omitempty"`
+	Extend         []string          `json:"extend,omitempty"`
+	Prefix         string            `json:"prefix,omitempty"`
+	Discriminator  string            `json:"discriminator,omitempty"`
+	LookupColumn   string            `json:"lookupColumn,omitempty"`
+	Enum           bool              `json:"enum,omitempty"`
+	AttributeKey   string            `json:"attributeKey,omitempty"`
+	AttributeValue string            `json:"attributeValue,omitempty"`
+	AttributeArray bool              `json:"attributeArray,omitempty"`
+	BucketSize     int               `json:"bucketSize,omitempty"`
+	BucketColumn   string            `json:"bucketColumn,omitempty"`
+	BucketWindow   string            `json:"bucketWindow,omitempty"`
+	Overflow       bool              `json:"overflow,omitempty"`
+}
+
+// Mapping returns the mapping of the added tables, sorted by table name
+func (t *DependencyTree) Mapping() *Mapping {
+	mapping := &Mapping{
+		Version:       MappingVersion,
+		Dialect:       t.dialect().Name,
+		References:    t.References,
+		Discriminator: t.DiscriminatorField,
+	}
+	if t.Naming != (Naming{}) {
+		naming := t.Naming
+		mapping.Naming = &naming
+	}
+
+	var names []string
+	for _, added := range t.AddedTables {
+		names = append(names, added.Table.Name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		added := t.added(name)
+		mapping.Tables = append(mapping.Tables, TableMapping{
+			Table:          name,
+			Mode:           added.Mode,
+			Where:          added.Where,
+			Sample:         added.Sample,
+			ChangeColumn:   added.ChangeColumn,
+			Rename:         added.Rename,
+			Include:        added.Include,
+			Exclude:        added.Exclude,
+			OrderBy:        added.OrderBy,
+			MaxItems:       added.MaxItems,
+			Parent:         added.Parent,
+			FarSide:        added.FarSide,
+			FarMode:        added.FarMode,
+			Naming:         added.Naming,
+			Collection:     added.Collection,
+			Computed:       added.Computed,
+			Extend:         added.Extend,
+			Prefix:         added.Prefix,
+			Discriminator:  added.Discriminator,
+			LookupColumn:   added.LookupColumn,
+			Enum:           added.Enum,
+			AttributeKey:   added.AttributeKey,
+			AttributeValue: added.AttributeValue,
+			AttributeArray: added.AttributeArray,
+			BucketSize:     added.BucketSize,
+			BucketColumn:   added.BucketColumn,
+			BucketWindow:   added.BucketWindow,
+			Overflow:       added.Overflow,
+		})
+	}
+
+	return mapping
+}
+
+// SetMapping replaces the added tables with the ones of mapping,
+// keeping the high-water marks of the ones tracked as before.
+// Nothing is changed if the mapping does not fit the tree's database.
+func (t *DependencyTree) SetMapping(mapping *Mapping) error {
+	if mapping.Version != MappingVersion {
+		return fmt.Errorf("mapping version %d is not supported, expected %d", mapping.Version, MappingVersion)
+	}
+	if mapping.Dialect != "" && mapping.Dialect != t.dialect().Name {
+		return fmt.Errorf("mapping is for %s, not %s", mapping.Dialect, t.dialect().Name)
+	}
+
+	var naming Naming
+	if mapping.Naming != nil {
+		naming = *mapping.Naming
+	}
+	if err := naming.Validate(); err != nil {
+		return fmt.Errorf("mapping naming: %v", err)
+	}
+
+	modes := make(map[string]TransformMode)
+	for _, table := range mapping.Tables {
+		if table.Naming != nil {
+			if err := table.Naming.Validate(); err != nil {
+				return fmt.Errorf("mapping naming of %s: %v", table.Table, err)
+			}
+		}
+		if !containsString(t.Prepared.Tables, table.Table) {
+			return fmt.Errorf("mapping has unknown table %s", table.Table)
+		}
+		if _, found := modes[table.Table]; found {
+			return fmt.Errorf("mapping has table %s twice", table.Table)
+		}
+		if _, found := transformModeNames[table.Mode]; !found {
+			return fmt.Errorf("mapping has no mode for table %s", table.Table)
+		}
+		for col := range table.Rename {
+			if !t.isField(table.Table, col) {
+				return fmt.Errorf("mapping renames unknown field %s.%s", table.Table, col)
+			}
+		}
+		for _, col := range table.Include {
+			if !containsString(t.Prepared.Cols[table.Table], col) {
+				return fmt.Errorf("mapping includes unknown column %s.%s", table.Table, col)
+			}
+		}
+		for _, col := range table.Exclude {
+			if !containsString(t.Prepared.Cols[table.Table], col) {
+				return fmt.Errorf("mapping excludes unknown column %s.%s", table.Table, col)
+			}
+		}
+		if table.LookupColumn != "" && !containsString(t.Prepared.Cols[table.Table], table.LookupColumn) {
+			return fmt.Errorf("mapping looks up unknown column %s.%s", table.Table, table.LookupColumn)
+		}
+		if _, found := t.Prepared.FKs[table.Table][table.Parent]; table.Parent != "" && !found {
+			return fmt.Errorf("mapping has %s in the arrays of %s, which it does not refer to", table.Table, table.Parent)
+		}
+		if table.BucketColumn != "" && !containsString(t.Prepared.Cols[table.Table], table.BucketColumn) {
+			return fmt.Errorf("mapping buckets by unknown column %s.%s", table.Table, table.BucketColumn)
+		}
+		if _, found := BucketWindows[table.BucketWindow]; table.BucketWindow != "" && !found {
+			return fmt.Errorf("mapping buckets %s by unknown window %s", table.Table, table.BucketWindow)
+		}
+		for _, col := range []string{table.AttributeKey, table.AttributeValue} {
+			if col != "" && !containsString(t.Prepared.Cols[table.Table], col) {
+				return fmt.Errorf("mapping has unknown attribute column %s.%s", table.Table, col)
+			}
+		}
+		for _, col := range table.Extend {
+			if !containsString(t.Prepared.Cols[table.Table], col) {
+				return fmt.Errorf("mapping extends references with unknown column %s.%s", table.Table, col)
+			}
+		}
+		for _, computed := range table.Computed {
+			if err := t.checkComputed(table.Table, computed); err != nil {
+				return fmt.Errorf("mapping: %v", err)
+			}
+		}
+		modes[table.Table] = table.Mode
+	}
+
+	// tables tracked by the same column as before keep their marks
+	marks := make(map[string]interface{})
+	for _, added := range t.AddedTables {
+		marks[added.Table.Name+"."+added.ChangeColumn] = added.HighWaterMark
+	}
+
+	t.Naming = naming
+	t.References = mapping.References
+	t.DiscriminatorField = mapping.Discriminator
+	t.AddedTables = nil
+	t.Resolve(modes)
+	for _, table := range mapping.Tables {
+		t.SetFilter(table.Table, table.Where, table.Sample)
+		t.SetChangeTracking(table.Table, table.ChangeColumn, marks[table.Table+"."+table.ChangeColumn])
+		t.SetFields(table.Table, table.Rename)
+		t.SetProjection(table.Table, table.Include, table.Exclude)
+		t.SetArrayOptions(table.Table, table.OrderBy, table.MaxItems)
+		t.SetArrayParent(table.Table, table.Parent)
+		t.SetFarSide(table.Table, table.FarSide, table.FarMode)
+		t.SetNaming(table.Table, table.Naming)
+		t.SetCollection(table.Table, table.Collection)
+		t.SetComputed(table.Table, table.Computed)
+		t.SetExtendedReference(table.Table, table.Extend)
+		t.SetMergePrefix(table.Table, table.Prefix)
+		t.SetDiscriminator(table.Table, table.Discriminator)
+		t.SetLookup(table.Table, table.LookupColumn, table.Enum)
+		t.SetAttributes(table.Table, table.AttributeKey, table.AttributeValue, table.AttributeArray)
+		t.SetBucket(table.Table, table.BucketSize, table.BucketColumn, table.BucketWindow)
+		t.SetOverflow(table.Table, table.Overflow)
+	}
+
+	return nil
+}
+
+// isField tells whether name may be a field of table's documents,
+// either one of its columns or a table related to it
+func (t *DependencyTree) isField(table, name string) bool {
+	if containsString(t.Prepared.Cols[table], name) {
+		return true
+	}
+	if _, found := t.Prepared.FKs[table][name]; found {
+		return true
+	}
+	_, found := t.Prepared.FKs[name][table]
+	return found
+}
+
+// LoadMapping reads a JSON mapping file into the tree,
+// see SetMapping
+func (t *DependencyTree) LoadMapping(r io.Reader) error {
+	var mapping Mapping
+	if err := json.NewDecoder(r).Decode(&mapping); err != nil {
+		return err
+	}
+
+	return t.SetMapping(&mapping)
+}
+
+// SaveMapping writes the tree's mapping as a JSON mapping file,
+// indented so it reads well in diffs
+func (t *DependencyTree) SaveMapping(w io.Writer) error {
+	data, err := json.MarshalIndent(t.Mapping(), "", "\t")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+var transformModeNames = map[TransformMode]string{
+	SimpleTransform:     "simple",
+	EmbeddedTransform:   "embedded",
+	ReferencedTransform: "referenced",
+	NxNTransform:        "nxn",
+	ArrayTransform:      "array",
+	MergeTransform:      "merge",
+	SubtypeTransform:    "subtype",
+	LookupTransform:     "lookup",
+	AttributeTransform:  "attribute",
+}
+
+func (mode TransformMode) String() string {
+	if name, found := transformModeNames[mode]; found {
+		return name
+	}
+	return fmt.Sprintf("TransformMode(%d)", int(mode))
+}
+
+// MarshalText writes the mode by its name in mapping files
+func (mode TransformMode) MarshalText() ([]byte, error) {
+	if name, found := transformModeNames[mode]; found {
+		return []byte(name), nil
+	}
+	return nil, fmt.Errorf("unknown transform mode %d", int(mode))
+}
+
+// UnmarshalText reads the mode by its name in mapping files
+func (mode *TransformMode) UnmarshalText(text []byte) error {
+	for m, name := range transformModeNames {
+		if name == string(text) {
+			*mode = m
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown transform mode %q", text)
+}
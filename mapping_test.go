@@ -0,0 +1,57 @@
+package mongifylab_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestMappingRoundTrip(t *testing.T) {
+	tree := newElectionTree()
+	tree.Add("ESTADO", mongifylab.EmbeddedTransform)
+	tree.Add("CIDADE", mongifylab.EmbeddedTransform)
+	tree.Add("CANDIDATO", mongifylab.SimpleTransform)
+	tree.Add("CANDIDATURA", mongifylab.NxNTransform)
+	tree.SetFilter("CANDIDATO", "ID > 10", 50)
+	tree.SetChangeTracking("CANDIDATO", "ALTERADO", 42)
+	tree.SetFields("CANDIDATO", map[string]string{"NOME": "nome", "CIDADE": "naturalidade"})
+	tree.SetProjection("CANDIDATO", nil, []string{"PARTIDO"})
+
+	var buf bytes.Buffer
+	if err := tree.SaveMapping(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.String()
+	if !strings.Contains(saved, `"mode": "nxn"`) || strings.Contains(saved, "42") {
+		t.Error("unexpected mapping file:", saved)
+	}
+
+	loaded := newElectionTree()
+	loaded.Add("PLEITO", mongifylab.SimpleTransform)
+	if err := loaded.LoadMapping(strings.NewReader(saved)); err != nil {
+		t.Fatal(err)
+	}
+	if shape(loaded) != shape(tree) {
+		t.Errorf("expected:\n%s\ngot:\n%s", shape(tree), shape(loaded))
+	}
+	if !reflect.DeepEqual(loaded.Mapping(), tree.Mapping()) {
+		t.Errorf("expected %+v, got %+v", tree.Mapping(), loaded.Mapping())
+	}
+
+	for _, bad := range []string{
+		`{"version": 2, "tables": []}`,
+		`{"version": 1, "tables": [{"table": "ELEITOR", "mode": "simple"}]}`,
+		`{"version": 1, "tables": [{"table": "CARGO", "mode": "linked"}]}`,
+		`{"version": 1, "tables": [{"table": "CARGO", "mode": "simple", "exclude": ["SALARIO"]}]}`,
+	} {
+		if err := loaded.LoadMapping(strings.NewReader(bad)); err == nil {
+			t.Error("loaded bad mapping:", bad)
+		}
+	}
+	if shape(loaded) != shape(tree) {
+		t.Error("bad mapping changed the tree:", shape(loaded))
+	}
+}
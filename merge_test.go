@@ -0,0 +1,73 @@
+package mongifylab_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestMergeTransform(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "CLIENTE")
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`INSERT INTO CLIENTE VALUES (1, 100)`); err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO":  mongifylab.EmbeddedTransform,
+		"CIDADE":  mongifylab.MergeTransform,
+		"PESSOA":  mongifylab.MergeTransform,
+		"CLIENTE": mongifylab.SimpleTransform,
+	})
+
+	// documents would have NOME twice
+	if _, err := tree.CreateCollectionScript(sqlite); err == nil {
+		t.Error("expected the clashing fields to be refused")
+	}
+
+	issues := tree.Validate()
+	for _, expected := range []string{
+		"warning: PESSOA: merges CIDADE, but they do not share the primary key",
+		"error: PESSOA: merges CIDADE, whose field NOME it has already",
+	} {
+		if !strings.Contains(fmt.Sprint(issues), expected) {
+			t.Errorf("expected %s, got %v", expected, issues)
+		}
+	}
+	if strings.Contains(fmt.Sprint(issues), "CLIENTE") {
+		t.Errorf("expected CLIENTE to merge PESSOA cleanly, got %v", issues)
+	}
+
+	// clashes with the tables merged in turn are found too
+	tree.SetFields("CIDADE", map[string]string{"NOME": "LIMITE"})
+	issues = tree.Validate()
+	if expected := "error: CLIENTE: merges PESSOA, whose field LIMITE it has already"; !strings.Contains(fmt.Sprint(issues), expected) {
+		t.Errorf("expected %s, got %v", expected, issues)
+	}
+	tree.SetFields("CIDADE", nil)
+
+	tree.SetMergePrefix("CIDADE", "cidade")
+	if issues := tree.Validate(); mongifylab.HasErrors(issues) {
+		t.Errorf("expected the prefix to settle the clash, got %v", issues)
+	}
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{_id: {ID: 1}, LIMITE: 100, NOME: "Ana", CIDADE: 1, cidade: {NOME: "Campinas", ESTADO: {SIGLA: "SP", NOME: "Sao Paulo"}}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	var buf bytes.Buffer
+	if err := tree.SaveMapping(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if saved := buf.String(); !strings.Contains(saved, `"mode": "merge"`) || !strings.Contains(saved, `"prefix": "cidade"`) {
+		t.Errorf("expected merge options in:\n%s", saved)
+	}
+}
@@ -0,0 +1,217 @@
+package mongifylab
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Naming is how the names of tables and columns become the names of
+// collections and fields. The zero Naming keeps them as they are.
+type Naming struct {
+	// StripPrefix is a regular expression matching a prefix taken out of
+	// names, e.g. "^LE[0-9]+" turns LE01ESTADO into ESTADO
+	StripPrefix string `json:"stripPrefix,omitempty"`
+
+	// Case is the name of one of Cases, words are kept as they are if empty
+	Case string `json:"case,omitempty"`
+
+	// PluralArrays names arrays in the plural, by Plural
+	PluralArrays bool `json:"pluralArrays,omitempty"`
+}
+
+// Cases are the ways of joining the words of a name, by their names.
+// More may be registered before naming anything.
+var Cases = map[string]func(words []string) string{
+	"camelCase": func(words []string) string {
+		for i, word := range words {
+			words[i] = strings.ToLower(word)
+			if i > 0 {
+				words[i] = capitalize(words[i])
+			}
+		}
+		return strings.Join(words, "")
+	},
+	"PascalCase": func(words []string) string {
+		for i, word := range words {
+			words[i] = capitalize(strings.ToLower(word))
+		}
+		return strings.Join(words, "")
+	},
+	"snake_case": func(words []string) string {
+		for i, word := range words {
+			words[i] = strings.ToLower(word)
+		}
+		return strings.Join(words, "_")
+	},
+}
+
+// Plural returns the plural of a word, in whichever case it is written.
+// It knows the most regular rules of Portuguese and English,
+// and may be replaced for other languages.
+var Plural = func(word string) string {
+	lower := strings.ToLower(word)
+	suffix := "s"
+	switch {
+	case strings.HasSuffix(lower, "ao"):
+		word, suffix = word[:len(word)-2], "oes"
+	case strings.HasSuffix(lower, "s"), strings.HasSuffix(lower, "r"), strings.HasSuffix(lower, "z"):
+		suffix = "es"
+	}
+
+	if word == strings.ToUpper(word) {
+		suffix = strings.ToUpper(suffix)
+	}
+	return word + suffix
+}
+
+// Validate tells whether the naming may be used
+func (n Naming) Validate() error {
+	if _, err := regexp.Compile(n.StripPrefix); err != nil {
+		return err
+	}
+	if _, found := Cases[n.Case]; n.Case != "" && !found {
+		return fmt.Errorf("unknown case %s", n.Case)
+	}
+	return nil
+}
+
+// Name returns the name given to a table or column,
+// in the plural if it names an array
+func (n Naming) Name(name string, isArray bool) string {
+	if n.StripPrefix != "" {
+		if prefix, err := regexp.Compile(n.StripPrefix); err == nil {
+			if stripped := prefix.ReplaceAllString(name, ""); stripped != "" {
+				name = stripped
+			}
+		}
+	}
+
+	pluralize := isArray && n.PluralArrays
+	join, found := Cases[n.Case]
+	if !found {
+		if pluralize {
+			return Plural(name)
+		}
+		return name
+	}
+
+	words := splitWords(name)
+	if len(words) == 0 {
+		return name
+	}
+	if pluralize {
+		words[len(words)-1] = Plural(words[len(words)-1])
+	}
+	return join(words)
+}
+
+// splitWords splits a name at underscores and other separators,
+// and where lower case letters are followed by upper case ones
+func splitWords(name string) []string {
+	var words []string
+	var word []rune
+	var last rune
+	for _, r := range name {
+		switch {
+		case !unicode.IsLetter(r) && !unicode.IsDigit(r):
+			if len(word) > 0 {
+				words = append(words, string(word))
+			}
+			word = nil
+		case unicode.IsUpper(r) && unicode.IsLower(last) && len(word) > 0:
+			words = append(words, string(word))
+			word = []rune{r}
+		default:
+			word = append(word, r)
+		}
+		last = r
+	}
+	if len(word) > 0 {
+		words = append(words, string(word))
+	}
+
+	return words
+}
+
+func capitalize(word string) string {
+	for i, r := range word {
+		return string(unicode.ToUpper(r)) + word[i+len(string(r)):]
+	}
+	return word
+}
+
+// naming returns the naming of the fields of table
+func (t *DependencyTree) naming(table string) Naming {
+	if added := t.added(table); added != nil && added.Naming != nil {
+		return *added.Naming
+	}
+	return t.Naming
+}
+
+// fieldName returns the name in the documents of the field name of table,
+// renamed or else named by the naming of table
+func (t *DependencyTree) fieldName(table, name string, isArray bool) string {
+	if added := t.added(table); added != nil {
+		if field, found := added.Rename[name]; found && field != "" {
+			return field
+		}
+	}
+	return t.naming(table).Name(name, isArray)
+}
+
+// CollectionName returns the name of the collection holding the documents
+// of table, as set by SetCollection or else named by the naming of table
+func (t *DependencyTree) CollectionName(table string) string {
+	if added := t.added(table); added != nil && added.Collection != "" {
+		return added.Collection
+	}
+	return t.naming(table).Name(table, false)
+}
+
+// SetNaming sets how the fields of an added table are named,
+// instead of the tree's Naming, nil sets it back
+func (t *DependencyTree) SetNaming(table string, naming *Naming) {
+	if added := t.added(table); added != nil {
+		added.Naming = naming
+	}
+}
+
+// SetCollection names the collection of an added table,
+// empty names it by its naming
+func (t *DependencyTree) SetCollection(table, collection string) {
+	if added := t.added(table); added != nil {
+		added.Collection = collection
+	}
+}
+
+// fieldPath returns the dotted path of the field col of table is written to
+// in the documents of table, or else just its field name
+func (t *DependencyTree) fieldPath(table *TableNode, col string) string {
+	var find func(cols []*BsonColumn, prefix string) string
+	find = func(cols []*BsonColumn, prefix string) string {
+		for _, c := range cols {
+			if c.IsArray {
+				continue
+			}
+			if len(c.InnerColumns) > 0 {
+				innerPrefix := prefix + c.Field + "."
+				if c.variant != "" {
+					innerPrefix = prefix
+				}
+				if path := find(c.InnerColumns, innerPrefix); path != "" {
+					return path
+				}
+			} else if c.Table == table.Name && c.Path == table.Name && c.Name == col {
+				return prefix + c.Field
+			}
+		}
+		return ""
+	}
+
+	if path := find(t.prepareColumns(nil, table, table.Name, false), ""); path != "" {
+		return path
+	}
+	return t.fieldName(table.Name, col, false)
+}
@@ -0,0 +1,88 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestNamingName(t *testing.T) {
+	tests := []struct {
+		naming  mongifylab.Naming
+		name    string
+		isArray bool
+		want    string
+	}{
+		{mongifylab.Naming{}, "LE01ESTADO", false, "LE01ESTADO"},
+		{mongifylab.Naming{StripPrefix: "^LE[0-9]+", Case: "camelCase"}, "LE01ESTADO", false, "estado"},
+		{mongifylab.Naming{Case: "camelCase"}, "SIGLA_ESTADO", false, "siglaEstado"},
+		{mongifylab.Naming{Case: "snake_case"}, "SiglaEstado", false, "sigla_estado"},
+		{mongifylab.Naming{Case: "PascalCase", PluralArrays: true}, "LE06SESSAO", true, "Le06sessoes"},
+		{mongifylab.Naming{StripPrefix: "^LE[0-9]+", PluralArrays: true}, "LE13INTENCAODEVOTO", true, "INTENCAODEVOTOS"},
+		{mongifylab.Naming{PluralArrays: true}, "ELEITOR", false, "ELEITOR"},
+		{mongifylab.Naming{PluralArrays: true}, "ELEITOR", true, "ELEITORES"},
+	}
+
+	for _, test := range tests {
+		if got := test.naming.Name(test.name, test.isArray); got != test.want {
+			t.Errorf("%+v named %s as %s, want %s", test.naming, test.name, got, test.want)
+		}
+	}
+
+	if err := (mongifylab.Naming{Case: "kebab-case"}).Validate(); err == nil {
+		t.Error("unknown case was accepted")
+	}
+}
+
+func TestNamingScripts(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.Prepared.UNs = map[string][][]string{"PESSOA": {{"NOME"}, {"ID", "NOME"}}}
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO": mongifylab.EmbeddedTransform,
+		"CIDADE": mongifylab.SimpleTransform,
+		"PESSOA": mongifylab.ArrayTransform,
+	})
+	tree.Naming = mongifylab.Naming{Case: "camelCase", PluralArrays: true}
+	tree.SetFields("CIDADE", map[string]string{"NOME": "nomeCidade"})
+	tree.SetNaming("ESTADO", &mongifylab.Naming{Case: "snake_case"})
+	tree.SetCollection("CIDADE", "cidades")
+	tree.SetArrayOptions("PESSOA", "", 100)
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `db.cidades.insert([
+	{_id: {id: 1}, nomeCidade: "Campinas", estado: {sigla: "SP", nome: "Sao Paulo"}, 
+		pessoas: [{id: 1, nome: "Ana", cidade: 1}, `
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	if find := tree.CreateFindScript("CIDADE", map[string]mongifylab.QueryInput{"ID": {Operator: "=", Text: "1"}}); find != `db.cidades.find({$or: {"_id.id": {$eq: 1}}})` {
+		t.Error("unexpected find script:", find)
+	}
+
+	validator, err := tree.CreateValidatorScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, schema := range []string{
+		`db.runCommand({collMod: "cidades", validator: {$jsonSchema: {bsonType: "object", required: ["_id"], properties: {_id: {bsonType: "object", required: ["id"], properties: {id: {}}}, `,
+		`estado: {bsonType: "object", properties: {sigla: {}, nome: {}}}`,
+		`pessoas: {bsonType: "array", maxItems: 100, items: {bsonType: "object", properties: {id: {}, nome: {}, cidade: {}}}}`,
+	} {
+		if !strings.Contains(validator, schema) {
+			t.Errorf("missing %s in:\n%s", schema, validator)
+		}
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{"PESSOA": mongifylab.SimpleTransform})
+	index := tree.CreateIndexScript()
+	if !strings.Contains(index, "db.pessoa.createIndex({nome: 1})\ndb.pessoa.createIndex({\"_id.id\": 1, nome: 1})\n") {
+		t.Error("unexpected index script:", index)
+	}
+}
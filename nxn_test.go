@@ -0,0 +1,133 @@
+package mongifylab_test
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestSeveralNxN(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "IDIOMA", "FALA")
+	defer sqlite.Close()
+
+	// FALA relates PESSOA to IDIOMA, and tells the CIDADE it was learnt in
+	_, err := sqlite.Exec(`
+	INSERT INTO IDIOMA VALUES (1, 'Ingles');
+	INSERT INTO FALA VALUES (1, 1, 1);
+	INSERT INTO SOCIO VALUES (1, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO": mongifylab.EmbeddedTransform,
+		"CIDADE": mongifylab.ReferencedTransform,
+		"PESSOA": mongifylab.ReferencedTransform,
+		"IDIOMA": mongifylab.EmbeddedTransform,
+		"SOCIO":  mongifylab.NxNTransform,
+		"FALA":   mongifylab.NxNTransform,
+	})
+	tree.SetFields("PESSOA", map[string]string{"FALA": "idiomas", "SOCIO": "clubes"})
+
+	expected := `CIDADE
+	ESTADO
+PESSOA
+	-> CIDADE
+	(N:N IDIOMA)
+	FALA
+		IDIOMA
+		-> CIDADE
+	(N:N CLUBE)
+	SOCIO
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, array := range []string{
+		`idiomas: [{IDIOMA: {ID: 1, NOME: "Ingles"}, CIDADE: {ID: 1}}, ]`,
+		`clubes: [{CLUBE: 1}, ]`,
+	} {
+		if !strings.Contains(script, array) {
+			t.Errorf("missing %s in:\n%s", array, script)
+		}
+	}
+
+	tree.SetFarSide("FALA", "", mongifylab.ReferencedTransform)
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if array := `idiomas: [{IDIOMA: {ID: 1}, CIDADE: {ID: 1}}, ]`; !strings.Contains(script, array) {
+		t.Errorf("missing %s in:\n%s", array, script)
+	}
+
+	tree.SetFarSide("FALA", "CIDADE", 0)
+	if issues := tree.Validate(); !mongifylab.HasErrors(issues) {
+		t.Error("far side outside the primary key was not told:", issues)
+	}
+}
+
+// newLanguageTree returns the tree of PESSOA with the languages each one
+// speaks as an NxN array, embedding IDIOMA, and IDIOMA tracked by ALTERADO
+func newLanguageTree(t *testing.T) (*sql.DB, *mongifylab.DependencyTree) {
+	sqlite, tree := newSQLiteTree(t, "IDIOMA", "FALA", "IDIOMA.ALTERADO")
+	_, err := sqlite.Exec(`
+	INSERT INTO IDIOMA VALUES (1, 'Ingles', 1);
+	INSERT INTO IDIOMA VALUES (2, 'Frances', 2);
+	INSERT INTO FALA VALUES (1, 1, 1);
+	INSERT INTO FALA VALUES (2, 2, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO": mongifylab.EmbeddedTransform,
+		"CIDADE": mongifylab.ReferencedTransform,
+		"PESSOA": mongifylab.SimpleTransform,
+		"IDIOMA": mongifylab.EmbeddedTransform,
+		"FALA":   mongifylab.NxNTransform,
+	})
+	tree.SetChangeTracking("IDIOMA", "ALTERADO", nil)
+
+	return sqlite, tree
+}
+
+func TestNxNFarSideChanges(t *testing.T) {
+	sqlite, tree := newLanguageTree(t)
+	defer sqlite.Close()
+
+	// the documents holding a language within their arrays change with it
+	updates := pollAfter(t, sqlite, tree, `UPDATE IDIOMA SET NOME = 'English' WHERE ID = 1`)
+	if !strings.Contains(updates, `db.PESSOA.replaceOne({_id: {ID: 1}}, {_id: {ID: 1}, NOME: "Ana", `) ||
+		!strings.Contains(updates, `NOME: "English"`) || strings.Contains(updates, `{_id: {ID: 2}}`) {
+		t.Error("expected only the speaker of the language to be replaced in:\n" + updates)
+	}
+}
+
+func TestNxNFarSideDelta(t *testing.T) {
+	sqlite, tree := newLanguageTree(t)
+	defer sqlite.Close()
+
+	if _, err := tree.CreateDeltaScript(sqlite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sqlite.Exec(`UPDATE IDIOMA SET NOME = 'Francais', ALTERADO = 3 WHERE ID = 2`); err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := tree.CreateDeltaScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, `db.PESSOA.replaceOne({_id: {ID: 2}}, {_id: {ID: 2}, NOME: "Bia", `) ||
+		!strings.Contains(script, `NOME: "Francais"`) || strings.Contains(script, `{_id: {ID: 1}}`) {
+		t.Error("expected only the speaker of the language to be replaced in:\n" + script)
+	}
+}
@@ -0,0 +1,48 @@
+package mongifylab_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetProjection("PESSOA", []string{"CIDADE"}, nil)
+	tree.SetProjection("ESTADO", nil, []string{"NOME", "SIGLA"})
+
+	for _, root := range tree.Root {
+		if root.Name != "PESSOA" {
+			continue
+		}
+		query := tree.QueryForAll(root).SQL
+		if strings.Contains(query, `"PESSOA.NOME"`) || strings.Contains(query, `"PESSOA.CIDADE.ESTADO.NOME"`) {
+			t.Errorf("expected excluded columns left out of %s", query)
+		}
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{_id: {ID: 1}, CIDADE: {ID: 1, NOME: "Campinas", ESTADO: {SIGLA: "SP"}}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	mapping := tree.Mapping()
+	if err := tree.SetMapping(mapping); err != nil {
+		t.Fatal(err)
+	}
+	if again := tree.Mapping(); !reflect.DeepEqual(again, mapping) {
+		t.Errorf("expected %+v, got %+v", mapping, again)
+	}
+
+	mapping.Tables[0].Include = []string{"IDADE"}
+	if err := tree.SetMapping(mapping); err == nil {
+		t.Error("expected an error including an unknown column")
+	}
+}
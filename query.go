@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"log"
 	"strconv"
+	"strings"
 )
 
 // ListTables returns all relevant tables
@@ -210,73 +211,229 @@ func QueryColumnNames(db *sql.DB, table string) ([]string, error) {
 	return cols, nil
 }
 
-func (t *DependencyTree) QueryForAll(table *TableNode) string {
-	var colBuf, tableBuf bytes.Buffer
-	colBuf.WriteString("SELECT ")
-	t.writeColumns(&colBuf, t.Prepared.Cols[table.Name], table.Name, true)
-	tableBuf.WriteString(" FROM ")
-	tableBuf.WriteString(table.Name)
+// QueryColumnTypes returns the data type of each column of table,
+// by column name
+func QueryColumnTypes(db *sql.DB, table string) (map[string]string, error) {
+	query := `SELECT COLUMN_NAME, DATA_TYPE FROM USER_TAB_COLS
+	WHERE TABLE_NAME = (:t)`
 
-	t.writeJoinedTables(&colBuf, &tableBuf, table)
+	rows, err := db.Query(query, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	types := make(map[string]string)
+	for rows.Next() {
+		var col, dataType string
+		if err := rows.Scan(&col, &dataType); err != nil {
+			return nil, err
+		}
+		types[col] = dataType
+	}
+
+	return types, rows.Err()
+}
 
-	return colBuf.String() + tableBuf.String()
+// QueryForAll returns the query for every row of table matching its filter,
+// joined with the tables it embeds or references.
+// Columns are named PATH.COL, where PATH is the path of
+// table names by which each joined table was reached.
+func (t *DependencyTree) QueryForAll(table *TableNode) *Query {
+	return t.selectAll(table, nil).Query()
 }
 
-func (t *DependencyTree) writeColumns(buf *bytes.Buffer, cols []string, table string, firstStuff bool) {
-	sep := ""
-	if !firstStuff {
-		sep = ", "
+// QueryChanged is like QueryForAll, but only for the rows whose documents
+// hold any row changed since the high-water mark of its table,
+// as set by SetChangeTracking.
+// It is false when no table in the documents is tracked.
+func (t *DependencyTree) QueryChanged(table *TableNode) (*Query, bool) {
+	b, tracked := t.selectChanged(table)
+	if !tracked {
+		return nil, false
 	}
-	for _, col := range cols {
-		buf.WriteString(sep)
-		buf.WriteString(table)
-		buf.WriteRune('.')
-		buf.WriteString(col)
-		buf.WriteString(" AS \"")
-		buf.WriteString(table)
-		buf.WriteRune('.')
-		buf.WriteString(col)
-		buf.WriteRune('"')
-		sep = ", "
+
+	return b.Query(), true
+}
+
+// selectChanged builds the query of QueryChanged
+func (t *DependencyTree) selectChanged(table *TableNode) (*selectBuilder, bool) {
+	var changes []string
+	b := t.selectAll(table, &changes)
+	if len(changes) == 0 {
+		return nil, false
 	}
+	b.Where(strings.Join(changes, " OR "))
+
+	return b, true
 }
 
-func (t *DependencyTree) writeJoinedTables(colBuf, tableBuf *bytes.Buffer, table *TableNode) {
+// selectAll selects every row of table joined with its related tables.
+// If changes is not nil, it receives a predicate per tracked table
+// telling whether the row holds changes of it.
+func (t *DependencyTree) selectAll(table *TableNode, changes *[]string) *selectBuilder {
+	b := newSelect(t.dialect())
+	alias := b.From(table.Name)
+	b.paths[table.Name] = alias
+	t.filterRows(b, table.Name)
+	t.selectColumns(b, t.selectedColumns(table.Name), alias, table.Name)
+	t.selectComputed(b, table.Name, alias, table.Name)
+	if changes != nil {
+		t.changedRows(b, changes, table.Name, alias)
+	}
+	t.selectJoinedTables(b, table, alias, table.Name, changes)
 
-	writeTable := func(newTable string) {
-		tableBuf.WriteString(" LEFT JOIN ")
-		tableBuf.WriteString(newTable)
-		tableBuf.WriteString(" ON")
+	return b
+}
+
+// filterRows applies the filter set for table, right after it was
+// added to the query by From
+func (t *DependencyTree) filterRows(b *selectBuilder, table string) {
+	added := t.added(table)
+	if added == nil {
+		return
+	}
+
+	if added.Sample > 0 && added.Sample < 100 {
+		b.Sample(added.Sample)
+	}
+	if added.Where != "" {
+		b.Where(added.Where)
+	}
+}
+
+// selectColumns selects each col of the table aliased as alias,
+// named PATH.COL in the resulting rows
+func (t *DependencyTree) selectColumns(b *selectBuilder, cols []string, alias, path string) {
+	for _, col := range cols {
+		b.Column(alias, col, path+"."+col)
+	}
+}
 
+func (t *DependencyTree) selectJoinedTables(b *selectBuilder, table *TableNode, alias, path string, changes *[]string) {
+	join := func(newTable string) string {
 		fk := t.Prepared.FKs[table.Name][newTable]
-		sep := " "
-		for i := 0; i < len(fk.Columns); i++ {
-			tableBuf.WriteString(sep)
-			tableBuf.WriteString(table.Name)
-			tableBuf.WriteRune('.')
-			tableBuf.WriteString(fk.Columns[i])
-			tableBuf.WriteString(" = ")
-			tableBuf.WriteString(newTable)
-			tableBuf.WriteRune('.')
-			tableBuf.WriteString(fk.ForeignColumns[i])
-
-			sep = " AND "
-		}
+		return b.LeftJoin(newTable, fk.ForeignColumns, alias, fk.Columns)
 	}
 
 	for _, embedded := range table.Embedded {
-		t.writeColumns(colBuf, t.Prepared.Cols[embedded.Name], embedded.Name, false)
-		writeTable(embedded.Name)
-		// colBuf.WriteString(", ")
-		t.writeJoinedTables(colBuf, tableBuf, embedded)
+		embeddedAlias := join(embedded.Name)
+		embeddedPath := path + "." + embedded.Name
+		b.paths[embeddedPath] = embeddedAlias
+		t.selectColumns(b, t.selectedColumns(embedded.Name), embeddedAlias, embeddedPath)
+		t.selectComputed(b, embedded.Name, embeddedAlias, embeddedPath)
+		if changes != nil {
+			t.changedRows(b, changes, embedded.Name, embeddedAlias)
+		}
+		t.selectJoinedTables(b, embedded, embeddedAlias, embeddedPath, changes)
+	}
+
+	// subtypes are joined by their key, referring to the table's
+	for _, subtype := range table.Subtypes {
+		fk := t.Prepared.FKs[subtype.Name][table.Name]
+		subtypeAlias := b.LeftJoin(subtype.Name, fk.Columns, alias, fk.ForeignColumns)
+		subtypePath := path + "." + subtype.Name
+		b.paths[subtypePath] = subtypeAlias
+		t.selectColumns(b, t.selectedColumns(subtype.Name), subtypeAlias, subtypePath)
+		t.selectComputed(b, subtype.Name, subtypeAlias, subtypePath)
+		if changes != nil {
+			t.changedRows(b, changes, subtype.Name, subtypeAlias)
+		}
+		t.selectJoinedTables(b, subtype, subtypeAlias, subtypePath, changes)
 	}
 
 	for _, referenced := range table.Referenced {
-		t.writeColumns(colBuf, t.Prepared.PKs[referenced], referenced, false)
-		writeTable(referenced)
+		referencedAlias := join(referenced)
+		t.selectColumns(b, t.referenceColumns(referenced), referencedAlias, path+"."+referenced)
+	}
+
+	if changes != nil {
+		for _, nxn := range table.NxNProxy {
+			t.changedNxN(b, changes, nxn, table.Name, alias)
+		}
+		for _, array := range table.Arrays {
+			t.changedNxN(b, changes, array, table.Name, alias)
+		}
+	}
+}
+
+// changedRows appends the predicate telling whether the row of the table
+// aliased as alias changed, if it is tracked.
+// Tables never extracted before have changed altogether.
+func (t *DependencyTree) changedRows(b *selectBuilder, changes *[]string, table, alias string) {
+	added := t.added(table)
+	if added == nil || added.ChangeColumn == "" {
+		return
 	}
+
+	if added.HighWaterMark == nil {
+		*changes = append(*changes, "1 = 1")
+		return
+	}
+
+	*changes = append(*changes, b.Qualified(alias, added.ChangeColumn)+" > "+b.Bind(added.HighWaterMark))
+}
+
+// changedNxN appends the predicate telling whether any row of nxn related
+// to the row of the table aliased as alias changed, or any row its elements
+// hold, if any of them is tracked.
+// Array tables relate to their rows the same way.
+func (t *DependencyTree) changedNxN(b *selectBuilder, changes *[]string, nxn *TableNode, table, alias string) {
+	sub := b.Subquery()
+	nxnAlias := sub.From(nxn.Name)
+	var nxnChanges []string
+	t.changedRows(sub, &nxnChanges, nxn.Name, nxnAlias)
+	t.selectJoinedTables(sub, nxn, nxnAlias, nxn.Name, &nxnChanges)
+	if len(nxnChanges) == 0 {
+		return
+	}
+
+	// tables never extracted before have changed altogether
+	for _, change := range nxnChanges {
+		if change == "1 = 1" {
+			*changes = append(*changes, change)
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("EXISTS (SELECT 1 FROM ")
+	buf.Write(sub.from.Bytes())
+	buf.WriteString(" WHERE ")
+
+	fk := t.Prepared.FKs[nxn.Name][table]
+	for i := range fk.Columns {
+		buf.WriteString(b.Qualified(nxnAlias, fk.Columns[i]))
+		buf.WriteString(" = ")
+		buf.WriteString(b.Qualified(alias, fk.ForeignColumns[i]))
+		buf.WriteString(" AND ")
+	}
+
+	buf.WriteString("(" + strings.Join(nxnChanges, " OR ") + "))")
+	b.Bound(sub)
+
+	*changes = append(*changes, buf.String())
 }
 
+// QueryNxN returns the query for the rows of nxn whose cols match any of keys,
+// each key having one value per column, honouring the filter set for nxn
+func (t *DependencyTree) QueryNxN(nxn string, cols []string, keys [][]interface{}) *Query {
+	b := newSelect(t.dialect())
+	alias := b.From(nxn)
+	t.filterRows(b, nxn)
+	for _, col := range t.selectedColumns(nxn) {
+		b.Column(alias, col, col)
+	}
+	b.WhereIn(alias, cols, keys)
+
+	return b.Query()
+}
+
+// QueryNxN returns the SQL for every column of the rows of nxn whose cols
+// equal the binds :1, :2 and so on, for the rows of a single parent.
+//
+// Deprecated: use DependencyTree.QueryNxN, which quotes identifiers, binds
+// for the dialect of the tree and matches the keys of many parents at once.
 func QueryNxN(cols []string, nxn string) string {
 	var buf bytes.Buffer
 	buf.WriteString("SELECT * FROM ")
@@ -284,17 +441,63 @@ func QueryNxN(cols []string, nxn string) string {
 	buf.WriteString(" WHERE")
 
 	sep := " "
-	param := 1
-	for _, col := range cols {
+	for i, col := range cols {
 		buf.WriteString(sep)
 		buf.WriteString(col)
 		buf.WriteString(" = (:")
-		buf.WriteString(strconv.Itoa(param))
+		buf.WriteString(strconv.Itoa(i + 1))
 		buf.WriteString(")")
 
 		sep = " AND "
-		param++
 	}
 
 	return buf.String()
 }
+
+// QueryArray returns the query for the rows of an array or NxN table whose
+// cols match any of keys, joined with the tables it embeds or references,
+// honouring the filter and the ordering set for it.
+// Columns are named as by QueryForAll.
+func (t *DependencyTree) QueryArray(array *TableNode, cols []string, keys [][]interface{}) *Query {
+	b := t.selectAll(array, nil)
+	alias := b.paths[array.Name]
+	b.WhereIn(alias, cols, keys)
+
+	added := t.added(array.Name)
+	if added == nil {
+		return b.Query()
+	}
+	order := t.arrayOrder(b, array.Name, alias)
+	if added.OrderBy != "" {
+		b.OrderBy(strings.Join(order, ", "))
+	}
+
+	// arrays are cut down to MaxItems by the database, which the window
+	// requires an order for, even if the arrays have none
+	if added.Mode == ArrayTransform && added.MaxItems > 0 {
+		var partition []string
+		for _, col := range cols {
+			partition = append(partition, b.Qualified(alias, col))
+		}
+		if len(order) == 0 {
+			order = partition
+		}
+		b.Top(partition, strings.Join(order, ", "), added.MaxItems)
+	}
+
+	return b.Query()
+}
+
+// arrayOrder returns the expressions the rows of array, aliased as alias,
+// are ordered by: its ordering, if set, and then its primary key, so that
+// rows ordered the same are always cut down or bucketed alike
+func (t *DependencyTree) arrayOrder(b *selectBuilder, array, alias string) []string {
+	var order []string
+	if added := t.added(array); added != nil && added.OrderBy != "" {
+		order = append(order, added.OrderBy)
+	}
+	for _, col := range t.Prepared.PKs[array] {
+		order = append(order, b.Qualified(alias, col))
+	}
+	return order
+}
@@ -0,0 +1,160 @@
+package mongifylab
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// lookupMaxRows is the most rows a table may have
+	// to be embedded as a lookup table
+	lookupMaxRows = 1000
+
+	// lookupMaxFanIn is the most tables that may refer to a table
+	// for it to be embedded as a lookup table
+	lookupMaxFanIn = 3
+)
+
+// Recommendation is the mode proposed for a table, along with why
+type Recommendation struct {
+	Table  string
+	Mode   TransformMode
+	Reason string
+}
+
+// Recommend proposes a mode for every table, judging by the foreign keys
+// between them and by how many rows each one has:
+// junction tables, whose primary key is made of two or more foreign keys,
+// are NxN; tables no other refers to are Simple; the tables junctions relate
+// are Referenced, so the arrays have documents to go in; small lookup
+// tables few others refer to are Embedded; and any other referred table is
+// Referenced, as copying it would make too many or too large copies.
+// Recommendations are sorted by table name.
+func (t *DependencyTree) Recommend(db *sql.DB) ([]Recommendation, error) {
+	rows := make(map[string]int64)
+	for _, table := range t.Prepared.Tables {
+		count, err := t.countRows(db, table)
+		if err != nil {
+			return nil, err
+		}
+		rows[table] = count
+	}
+
+	// referrers[Table] = [Tables referring to it...]
+	referrers := make(map[string][]string)
+	for _, table := range t.Prepared.Tables {
+		for _, foreign := range t.foreignTables(table) {
+			if foreign != table {
+				referrers[foreign] = append(referrers[foreign], table)
+			}
+		}
+	}
+
+	var recommendations []Recommendation
+	tables := append([]string(nil), t.Prepared.Tables...)
+	sort.Strings(tables)
+	for _, table := range tables {
+		recommendation := Recommendation{Table: table}
+		fanIn := len(referrers[table])
+		fanOut := t.fanOut(table, referrers[table], rows)
+
+		junction := ""
+		for _, referrer := range referrers[table] {
+			if t.isJunction(referrer) {
+				junction = referrer
+				break
+			}
+		}
+
+		switch {
+		case t.isJunction(table):
+			recommendation.Mode = NxNTransform
+			recommendation.Reason = "junction of " + strings.Join(t.foreignTables(table), ", ")
+
+		case fanIn == 0:
+			recommendation.Mode = SimpleTransform
+			recommendation.Reason = "no table refers to it"
+
+		case junction != "":
+			recommendation.Mode = ReferencedTransform
+			recommendation.Reason = "related by the junction " + junction
+
+		case t.refersTo(table, table):
+			recommendation.Mode = ReferencedTransform
+			recommendation.Reason = "refers to itself, it cannot be embedded"
+
+		case rows[table] <= lookupMaxRows && fanIn <= lookupMaxFanIn:
+			recommendation.Mode = EmbeddedTransform
+			recommendation.Reason = fmt.Sprintf("lookup table of %d rows, referred by %s", rows[table], plural(fanIn, "table"))
+
+		case rows[table] > lookupMaxRows:
+			recommendation.Mode = ReferencedTransform
+			recommendation.Reason = fmt.Sprintf("%d rows, each referred by up to %.1f rows", rows[table], fanOut)
+
+		default:
+			recommendation.Mode = ReferencedTransform
+			recommendation.Reason = fmt.Sprintf("referred by %s", plural(fanIn, "table"))
+		}
+
+		recommendations = append(recommendations, recommendation)
+	}
+
+	return recommendations, nil
+}
+
+// isJunction tells whether the primary key of table is made of the columns
+// of two or more of its foreign keys, and nothing else
+func (t *DependencyTree) isJunction(table string) bool {
+	sides := t.junctionSides(table)
+	if len(sides) < 2 {
+		return false
+	}
+
+	fkCols := make(map[string]bool)
+	for _, side := range sides {
+		for _, col := range t.Prepared.FKs[table][side].Columns {
+			fkCols[col] = true
+		}
+	}
+
+	return len(fkCols) == len(t.Prepared.PKs[table])
+}
+
+// refersTo tells whether table has a foreign key to foreign
+func (t *DependencyTree) refersTo(table, foreign string) bool {
+	_, found := t.Prepared.FKs[table][foreign]
+	return found
+}
+
+// fanOut returns the most rows of a single referrer that each row of table
+// is referred by, on average
+func (t *DependencyTree) fanOut(table string, referrers []string, rows map[string]int64) float64 {
+	if rows[table] == 0 {
+		return 0
+	}
+
+	var most float64
+	for _, referrer := range referrers {
+		if fanOut := float64(rows[referrer]) / float64(rows[table]); fanOut > most {
+			most = fanOut
+		}
+	}
+	return most
+}
+
+// countRows returns how many rows table has
+func (t *DependencyTree) countRows(db *sql.DB, table string) (int64, error) {
+	var count int64
+	err := db.QueryRow("SELECT COUNT(*) FROM " + t.dialect().QuoteIdent(table)).Scan(&count)
+	return count, err
+}
+
+// plural writes n things, with an s unless there is a single one
+func plural(n int, thing string) string {
+	if n == 1 {
+		return "1 " + thing
+	}
+	return fmt.Sprintf("%d %ss", n, thing)
+}
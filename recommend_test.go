@@ -0,0 +1,34 @@
+package mongifylab_test
+
+import (
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestRecommend(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	recommendations, err := tree.Recommend(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]mongifylab.TransformMode{
+		"CIDADE": mongifylab.EmbeddedTransform,
+		"CLUBE":  mongifylab.ReferencedTransform,
+		"ESTADO": mongifylab.EmbeddedTransform,
+		"PESSOA": mongifylab.ReferencedTransform,
+		"SOCIO":  mongifylab.NxNTransform,
+	}
+	if len(recommendations) != len(expected) {
+		t.Fatal("expected a recommendation per table, got", recommendations)
+	}
+	for _, recommendation := range recommendations {
+		if recommendation.Mode != expected[recommendation.Table] || recommendation.Reason == "" {
+			t.Errorf("%s: expected %v, got %v (%s)", recommendation.Table,
+				expected[recommendation.Table], recommendation.Mode, recommendation.Reason)
+		}
+	}
+}
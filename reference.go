@@ -0,0 +1,146 @@
+package mongifylab
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+)
+
+// ReferenceFormat is how documents refer to the documents of other tables
+type ReferenceFormat int
+
+const (
+	// NaturalKeyReference refers by the primary key of the row,
+	// the _id of its document
+	NaturalKeyReference ReferenceFormat = iota
+
+	// DBRefReference refers by a DBRef, {$ref: collection, $id: _id}
+	DBRefReference
+
+	// ObjectIdReference gives every document an ObjectId _id derived from
+	// its primary key, which is kept as uniquely indexed fields, and refers
+	// by it. ObjectIds are the same whenever the same row is extracted, so
+	// they tell nothing of when it was: their timestamp, the first 4 bytes,
+	// is always the Unix epoch and the other 8 bytes hash the table and
+	// the key.
+	ObjectIdReference
+)
+
+var referenceFormatNames = map[ReferenceFormat]string{
+	NaturalKeyReference: "natural",
+	DBRefReference:      "dbref",
+	ObjectIdReference:   "objectid",
+}
+
+func (format ReferenceFormat) String() string {
+	if name, found := referenceFormatNames[format]; found {
+		return name
+	}
+	return fmt.Sprintf("ReferenceFormat(%d)", int(format))
+}
+
+// MarshalText writes the format by its name in mapping files
+func (format ReferenceFormat) MarshalText() ([]byte, error) {
+	if name, found := referenceFormatNames[format]; found {
+		return []byte(name), nil
+	}
+	return nil, fmt.Errorf("unknown reference format %d", int(format))
+}
+
+// UnmarshalText reads the format by its name in mapping files
+func (format *ReferenceFormat) UnmarshalText(text []byte) error {
+	for f, name := range referenceFormatNames {
+		if name == string(text) {
+			*format = f
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown reference format %q", text)
+}
+
+// objectIDTime is the timestamp of every ObjectId derived from a key,
+// in seconds since the Unix epoch
+const objectIDTime = 0
+
+// objectIDColumn returns the column holding the ObjectId of the row of
+// table at path, named field
+func objectIDColumn(table, path, field string) *BsonColumn {
+	c := NewColumn(table, "_id")
+	c.Field = field
+	c.Path = path
+	c.objectID = true
+	return c
+}
+
+// objectID returns the ObjectId of the row of c.Table at c.Path in m,
+// nil if its primary key is incomplete.
+// It is derived from the table name and the key, so it never changes,
+// even when the collection is renamed. Its timestamp is objectIDTime,
+// as ObjectId.getTimestamp() would otherwise read the hash as a time.
+func (t *DependencyTree) objectID(c *BsonColumn, m map[string]interface{}) interface{} {
+	key := []interface{}{c.Table}
+	for _, pk := range t.Prepared.PKs[c.Table] {
+		val := m[c.Path+"."+pk]
+		if val == nil {
+			return nil
+		}
+		key = append(key, val)
+	}
+
+	var id [12]byte
+	binary.BigEndian.PutUint32(id[:4], objectIDTime)
+	sum := sha1.Sum([]byte(lookupKey(key)))
+	copy(id[4:], sum[:])
+	return JS("ObjectId(\"" + hex.EncodeToString(id[:]) + "\")")
+}
+
+// referenceColumn returns the column referring to the row of referenced at
+// path, named field, written in the tree's reference format,
+// or the lookup column of a lookup table
+func (t *DependencyTree) referenceColumn(referenced, path, field string) *BsonColumn {
+	if col := t.lookupColumn(referenced); col != "" {
+		c := NewColumn(referenced, col)
+		c.Field = field
+		c.Path = path
+		return c
+	}
+
+	keyColumns := func(cols []string) []*BsonColumn {
+		var inner []*BsonColumn
+		for _, col := range cols {
+			c := NewColumn(referenced, col)
+			c.Field = t.fieldName(referenced, col, false)
+			c.Path = path
+			inner = append(inner, c)
+		}
+		return inner
+	}
+
+	pks := t.Prepared.PKs[referenced]
+	extend := removeDuplicate(t.referenceColumns(referenced), pks)
+
+	c := NewColumn("", referenced)
+	c.Field = field
+	switch t.References {
+	case DBRefReference:
+		ref := NewColumn("", "$ref")
+		ref.value = t.CollectionName(referenced)
+		id := NewColumn("", "$id")
+		id.InnerColumns = keyColumns(pks)
+		c.InnerColumns = append([]*BsonColumn{ref, id}, keyColumns(extend)...)
+
+	case ObjectIdReference:
+		id := objectIDColumn(referenced, path, "_id")
+		if len(extend) == 0 {
+			id.Field = field
+			return id
+		}
+		c.InnerColumns = append([]*BsonColumn{id}, keyColumns(extend)...)
+
+	default:
+		c.InnerColumns = keyColumns(t.referenceColumns(referenced))
+	}
+
+	return c
+}
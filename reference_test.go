@@ -0,0 +1,151 @@
+package mongifylab_test
+
+import (
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestReferenceFormats(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetMode("CIDADE", mongifylab.ReferencedTransform)
+	tree.SetExtendedReference("CIDADE", []string{"NOME"})
+
+	tree.References = mongifylab.DBRefReference
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{_id: {ID: 1}, NOME: "Ana", CIDADE: {$ref: "CIDADE", $id: {ID: 1}, NOME: "Campinas"}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	tree.References = mongifylab.ObjectIdReference
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// references hold the very ObjectId of the document they refer to
+	cidade := regexp.MustCompile(`\{_id: (ObjectId\("[0-9a-f]{24}"\)), ID: 1, NOME: "Campinas"`).FindStringSubmatch(script)
+	if cidade == nil {
+		t.Fatalf("missing the CIDADE document in:\n%s", script)
+	}
+	expected = `ID: 1, NOME: "Ana", CIDADE: {_id: ` + cidade[1] + `, NOME: "Campinas"}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	again, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again != script {
+		t.Error("expected the same ObjectIds extracting again")
+	}
+
+	if index := tree.CreateIndexScript(); !strings.Contains(index, "db.PESSOA.createIndex({ID: 1}, {unique: true})") {
+		t.Error("expected a unique index on the natural key in:\n", index)
+	}
+	validator, err := tree.CreateValidatorScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(validator, `properties: {_id: {bsonType: "objectId"}, ID: {}`) {
+		t.Error("expected an ObjectId _id in:\n", validator)
+	}
+
+	tree.SetExtendedReference("CIDADE", nil)
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `NOME: "Ana", CIDADE: ` + cidade[1] + `}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	mapping := tree.Mapping()
+	tree.References = mongifylab.NaturalKeyReference
+	if err := tree.SetMapping(mapping); err != nil || tree.References != mongifylab.ObjectIdReference {
+		t.Errorf("expected ObjectId references from the mapping, got %v (%v)", tree.References, err)
+	}
+
+	// ObjectIds come from the table, not the collection it is written to
+	tree.SetCollection("CIDADE", "cidades")
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(script, "{_id: "+cidade[1]+", ID: 1") {
+		t.Errorf("expected the ObjectId %s to stay in:\n%s", cidade[1], script)
+	}
+}
+
+func TestObjectIdKeyParts(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "PAR")
+	defer sqlite.Close()
+
+	// keys differing only by where a NUL is or by the time of day
+	if _, err := sqlite.Exec(`INSERT INTO PAR VALUES ('x' || char(0), '2024-01-01 10:00:00'), ('x', char(0) || '2024-01-01 10:00:00'),
+		('x', '2024-01-01 10:00:00'), ('x', '2024-01-01 11:00:00')`); err != nil {
+		t.Fatal(err)
+	}
+	tree.Reset()
+	tree.Add("PAR", mongifylab.SimpleTransform)
+	tree.References = mongifylab.ObjectIdReference
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the keys tell ObjectIds apart, the timestamp is the same
+	ids := make(map[string]bool)
+	for _, id := range regexp.MustCompile(`ObjectId\("[0-9a-f]{24}"\)`).FindAllString(script, -1) {
+		ids[id] = true
+		if !strings.HasPrefix(id, `ObjectId("00000000`) {
+			t.Error("expected the timestamp of the Unix epoch in", id)
+		}
+	}
+	if len(ids) != 4 {
+		t.Errorf("expected four different ObjectIds in:\n%s", script)
+	}
+}
+
+func TestExtendedReference(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetMode("CIDADE", mongifylab.ReferencedTransform)
+	tree.SetExtendedReference("CIDADE", []string{"NOME"})
+	tree.SetExtendedReference("ESTADO", []string{"NOME"})
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{_id: {ID: 1}, NOME: "Ana", CIDADE: {ID: 1, NOME: "Campinas"}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	issues := tree.Validate()
+	if len(issues) != 1 || issues[0].Table != "ESTADO" {
+		t.Errorf("expected a warning extending ESTADO, got %v", issues)
+	}
+
+	mapping := tree.Mapping()
+	if !reflect.DeepEqual(mapping.Tables[0].Extend, []string{"NOME"}) {
+		t.Errorf("expected the mapping to extend CIDADE by NOME, got %+v", mapping.Tables[0])
+	}
+	mapping.Tables[0].Extend = []string{"AREA"}
+	if err := tree.SetMapping(mapping); err == nil {
+		t.Error("expected an error extending by an unknown column")
+	}
+}
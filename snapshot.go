@@ -0,0 +1,53 @@
+package mongifylab
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// Querier is implemented by both *sql.DB and *sql.Tx, so extraction
+// queries may run either directly or inside a Snapshot
+type Querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Snapshot is a read-only transaction shared by every extraction query,
+// so that all tables are read as of the same point in time
+type Snapshot struct {
+	*sql.Tx
+
+	// Marker identifies the snapshot (e.g. Oracle's SCN), it is empty
+	// when the dialect has no way of telling it
+	Marker string
+}
+
+// BeginSnapshot starts a consistent read-only snapshot of db.
+// It must be finished with Rollback, as nothing is ever written.
+func (d *Dialect) BeginSnapshot(db *sql.DB) (*Snapshot, error) {
+	tx, err := db.BeginTx(context.Background(), d.SnapshotOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.SnapshotBegin != "" {
+		if _, err := tx.Exec(d.SnapshotBegin); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+
+	snapshot := &Snapshot{Tx: tx}
+	if d.SnapshotMarker != "" {
+		err := tx.QueryRow(d.SnapshotMarker).Scan(&snapshot.Marker)
+		if err != nil && d.SnapshotMarkerFallback != "" {
+			err = tx.QueryRow(d.SnapshotMarkerFallback).Scan(&snapshot.Marker)
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("marking the %s snapshot: %v", d.Name, err)
+		}
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,184 @@
+package mongifylab_test
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func init() {
+	sql.Register("sqlite3_one_cursor", oneCursorDriver{&sqlite3.SQLiteDriver{}})
+}
+
+// oneCursorDriver refuses to run a query while the rows of another are open
+// on the same connection, as lib/pq and go-sql-driver/mysql do
+type oneCursorDriver struct {
+	driver.Driver
+}
+
+func (d oneCursorDriver) Open(name string) (driver.Conn, error) {
+	conn, err := d.Driver.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &oneCursorConn{Conn: conn}, nil
+}
+
+type oneCursorConn struct {
+	driver.Conn
+	open bool
+}
+
+func (c *oneCursorConn) Prepare(query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	return &oneCursorStmt{Stmt: stmt, conn: c}, nil
+}
+
+// Exec runs scripts of many statements, as the sqlite3 connection does
+func (c *oneCursorConn) Exec(query string, args []driver.Value) (driver.Result, error) {
+	return c.Conn.(driver.Execer).Exec(query, args)
+}
+
+type oneCursorStmt struct {
+	driver.Stmt
+	conn *oneCursorConn
+}
+
+func (s *oneCursorStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if s.conn.open {
+		return nil, errors.New("another query is still being read")
+	}
+
+	rows, err := s.Stmt.Query(args)
+	if err != nil {
+		return nil, err
+	}
+	s.conn.open = true
+	return &oneCursorRows{Rows: rows, conn: s.conn}, nil
+}
+
+type oneCursorRows struct {
+	driver.Rows
+	conn *oneCursorConn
+}
+
+func (r *oneCursorRows) Close() error {
+	r.conn.open = false
+	return r.Rows.Close()
+}
+
+func TestSnapshotOneCursor(t *testing.T) {
+	sqlite, tree := newSQLiteTreeOn(t, "sqlite3_one_cursor")
+	defer sqlite.Close()
+
+	// many clubs, so that arrays would be fetched while clubs are still read
+	_, err := sqlite.Exec(`
+	WITH RECURSIVE N(ID) AS (SELECT 2 UNION ALL SELECT ID + 1 FROM N WHERE ID < 600)
+	INSERT INTO CLUBE SELECT ID, 'Clube ' || ID FROM N;
+	INSERT INTO SOCIO VALUES (1, 1);
+	INSERT INTO SOCIO VALUES (2, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(script, "\n") {
+		if strings.Contains(line, "SOCIO: [") {
+			if !strings.Contains(line, "PESSOA: 1") || !strings.Contains(line, "PESSOA: 2") {
+				t.Error("missing members of the club:", line)
+			}
+			return
+		}
+	}
+	t.Error("missing the members of the club in:\n" + script)
+}
+
+func TestSnapshotMarker(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	dialect := *mongifylab.SQLite
+	tree.Dialect = &dialect
+
+	dialect.SnapshotMarker = "SELECT 'mark 1'"
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(script, "/* Snapshot: mark 1 */\n") {
+		t.Error("snapshot is not marked:", script)
+	}
+
+	// markers may need privileges the user lacks
+	dialect.SnapshotMarker = "SELECT SCN FROM FLASHBACK"
+	if _, err := tree.CreateCollectionScript(sqlite); err == nil || !strings.Contains(err.Error(), "marking the sqlite snapshot") {
+		t.Error("expected an error marking the snapshot, got", err)
+	}
+
+	dialect.SnapshotMarkerFallback = "SELECT 'time 0'"
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(script, "/* Snapshot: time 0 */\n") {
+		t.Error("snapshot is not marked by the fallback:", script)
+	}
+
+	// markers are read once the snapshot is begun, within it
+	dialect.SnapshotBegin = "CREATE TEMP TABLE BEGUN AS SELECT 'mark 2' AS MARK"
+	dialect.SnapshotMarker = "SELECT MARK FROM BEGUN"
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(script, "/* Snapshot: mark 2 */\n") {
+		t.Error("snapshot is not marked after it began:", script)
+	}
+}
+
+func TestSnapshotPages(t *testing.T) {
+	sqlite, tree := newSQLiteTreeOn(t, "sqlite3_one_cursor", "ATRIBUTO")
+	defer sqlite.Close()
+
+	// pages of a composite key, the second one spanning both people
+	_, err := sqlite.Exec(`
+	WITH RECURSIVE N(I) AS (SELECT 1 UNION ALL SELECT I + 1 FROM N WHERE I < 700)
+	INSERT INTO ATRIBUTO SELECT PESSOA.ID, printf('C%04d', I), 'v' FROM N, PESSOA`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree.Add("ATRIBUTO", mongifylab.SimpleTransform)
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every row is written once, in the order of its key
+	var ids []string
+	for _, line := range strings.Split(script, "\n") {
+		if strings.HasPrefix(line, "\t{_id: {PESSOA: ") {
+			ids = append(ids, line[len("\t{_id: "):strings.Index(line, "}")+1])
+		}
+	}
+	if len(ids) != 1400 {
+		t.Fatalf("expected 1400 documents, got %d", len(ids))
+	}
+	for i, id := range ids {
+		if expected := fmt.Sprintf(`{PESSOA: %d, CHAVE: "C%04d"}`, i/700+1, i%700+1); id != expected {
+			t.Fatalf("expected %s, got %s", expected, id)
+		}
+	}
+}
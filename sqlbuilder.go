@@ -0,0 +1,415 @@
+package mongifylab
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Query is a statement built for a dialect, along with the names its
+// column aliases stand for, as long names may have been shortened
+type Query struct {
+	SQL  string
+	Args []interface{}
+
+	// Aliases[Alias] = Name
+	Aliases map[string]string
+}
+
+// Run runs the query, sending each row as a map (name -> value)
+// where names are the ones columns were selected as, not their aliases
+func (q *Query) Run(db Querier) (<-chan map[string]interface{}, error) {
+	rows, err := db.Query(q.SQL, q.Args...)
+	if err != nil {
+		return nil, err
+	}
+
+	rowChan, err := RowMapChan(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	namedChan := make(chan map[string]interface{}, 1)
+	go func() {
+		for row := range rowChan {
+			namedChan <- q.named(row)
+		}
+		close(namedChan)
+	}()
+
+	return namedChan, nil
+}
+
+// All runs the query and reads every row before returning them, named as
+// by Run. Unlike Run, it leaves no cursor open, so other queries may run on
+// the same connection while the rows are handled, as most drivers require
+// within a transaction.
+func (q *Query) All(db Querier) ([]map[string]interface{}, error) {
+	rows, err := db.Query(q.SQL, q.Args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	ptrs, err := allocateForScan(len(columns))
+	if err != nil {
+		return nil, err
+	}
+
+	var all []map[string]interface{}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, err
+		}
+
+		row := make(map[string]interface{}, len(ptrs))
+		for i := range ptrs {
+			row[columns[i]] = *(ptrs[i]).(*interface{})
+		}
+		all = append(all, q.named(row))
+	}
+
+	return all, rows.Err()
+}
+
+// named renames the columns of row from their aliases to their names
+func (q *Query) named(row map[string]interface{}) map[string]interface{} {
+	named := make(map[string]interface{}, len(row))
+	for alias, val := range row {
+		if name, found := q.Aliases[alias]; found {
+			named[name] = val
+		} else {
+			named[alias] = val
+		}
+	}
+	return named
+}
+
+// selectBuilder writes SELECT statements for a dialect, quoting
+// identifiers, shortening aliases and numbering binds
+type selectBuilder struct {
+	dialect  *Dialect
+	cols     bytes.Buffer
+	from     bytes.Buffer
+	where    bytes.Buffer
+	orderBy  string
+	first    string // alias of the table set by From
+	top      int
+	topOver  string        // window of the rows numbered for top
+	after    []string      // qualified columns the rows are paged by
+	afterKey []interface{} // key the rows of the page follow, if any
+	args     []interface{}
+	aliases  map[string]string // aliases[Alias] = Name
+	tables   map[string]string // tables[Alias] = Table
+	paths    map[string]string // paths[Path] = Alias, for joins made by path
+}
+
+func newSelect(d *Dialect) *selectBuilder {
+	return &selectBuilder{
+		dialect: d,
+		aliases: make(map[string]string),
+		tables:  make(map[string]string),
+		paths:   make(map[string]string),
+	}
+}
+
+// Column selects col from the table aliased as table,
+// to be named name in the resulting rows
+func (b *selectBuilder) Column(table, col, name string) {
+	if b.cols.Len() > 0 {
+		b.cols.WriteString(", ")
+	}
+	b.cols.WriteString(b.Qualified(table, col))
+	b.cols.WriteString(" AS ")
+
+	alias := uniqueIdent(b.dialect, name, b.aliases)
+	b.aliases[alias] = name
+	b.cols.WriteString(b.dialect.QuoteIdent(alias))
+}
+
+// Expression selects the SQL expression expr,
+// to be named name in the resulting rows
+func (b *selectBuilder) Expression(expr, name string) {
+	if b.cols.Len() > 0 {
+		b.cols.WriteString(", ")
+	}
+	b.cols.WriteString(expr)
+	b.cols.WriteString(" AS ")
+
+	alias := uniqueIdent(b.dialect, name, b.aliases)
+	b.aliases[alias] = name
+	b.cols.WriteString(b.dialect.QuoteIdent(alias))
+}
+
+// From sets the first table of the query, returning its alias
+func (b *selectBuilder) From(table string) string {
+	alias := b.tableAlias(table)
+	b.first = alias
+	b.writeTable(table, alias, "")
+
+	return alias
+}
+
+// Sample reads only about percent of the rows of the first table,
+// it must be called right after From
+func (b *selectBuilder) Sample(percent float64) {
+	if b.dialect.TableSample != "" {
+		b.from.Reset()
+		b.writeTable(b.tables[b.first], b.first, fmt.Sprintf(b.dialect.TableSample, percent))
+	} else if b.dialect.SamplePredicate != "" {
+		b.Where(fmt.Sprintf(b.dialect.SamplePredicate, percent))
+	}
+}
+
+// writeTable writes table aliased as alias to the FROM clause,
+// along with its sample clause, if any
+func (b *selectBuilder) writeTable(table, alias, sample string) {
+	b.from.WriteString(b.dialect.QuoteIdent(table))
+	if b.dialect.SampleBeforeAlias {
+		b.from.WriteString(sample)
+	}
+	if alias != table {
+		b.from.WriteRune(' ')
+		b.from.WriteString(b.dialect.QuoteIdent(alias))
+	}
+	if !b.dialect.SampleBeforeAlias {
+		b.from.WriteString(sample)
+	}
+}
+
+// LeftJoin joins newTable where its newCols equal the cols of the
+// table aliased as table, returning the alias of newTable.
+// Each join gets its own alias, so a table may be joined many times.
+func (b *selectBuilder) LeftJoin(newTable string, newCols []string, table string, cols []string) string {
+	newAlias := b.tableAlias(newTable)
+	b.from.WriteString(" LEFT JOIN ")
+	b.from.WriteString(b.dialect.QuoteIdent(newTable))
+	if newAlias != newTable {
+		b.from.WriteRune(' ')
+		b.from.WriteString(b.dialect.QuoteIdent(newAlias))
+	}
+	b.from.WriteString(" ON")
+
+	sep := " "
+	for i := range cols {
+		b.from.WriteString(sep)
+		b.from.WriteString(b.Qualified(table, cols[i]))
+		b.from.WriteString(" = ")
+		b.from.WriteString(b.Qualified(newAlias, newCols[i]))
+
+		sep = " AND "
+	}
+
+	return newAlias
+}
+
+// Where restricts the rows by a predicate, along with any previous ones
+func (b *selectBuilder) Where(predicate string) {
+	if b.where.Len() > 0 {
+		b.where.WriteString(" AND ")
+	}
+	b.where.WriteRune('(')
+	b.where.WriteString(predicate)
+	b.where.WriteRune(')')
+}
+
+// WhereIn restricts the rows to the ones whose cols, from the table aliased
+// as table, match any of keys, each key having one value per column
+func (b *selectBuilder) WhereIn(table string, cols []string, keys [][]interface{}) {
+	var buf bytes.Buffer
+
+	// single columns are compared plainly, composite keys as tuples
+	lparen, rparen := "", ""
+	if len(cols) > 1 {
+		lparen, rparen = "(", ")"
+	}
+
+	buf.WriteString(lparen)
+	sep := ""
+	for _, col := range cols {
+		buf.WriteString(sep)
+		buf.WriteString(b.Qualified(table, col))
+		sep = ", "
+	}
+	buf.WriteString(rparen)
+	buf.WriteString(" IN (")
+
+	keySep := ""
+	for _, key := range keys {
+		buf.WriteString(keySep)
+		buf.WriteString(lparen)
+		sep = ""
+		for _, val := range key {
+			buf.WriteString(sep)
+			buf.WriteString(b.Bind(val))
+			sep = ", "
+		}
+		buf.WriteString(rparen)
+		keySep = ", "
+	}
+	buf.WriteRune(')')
+
+	b.Where(buf.String())
+}
+
+// OrderBy orders the rows by an SQL expression
+func (b *selectBuilder) OrderBy(expr string) {
+	b.orderBy = expr
+}
+
+// Top keeps only the first n rows of each group of rows whose partition
+// expressions are the same, as ordered by order, which is required.
+// Rows are then ordered by their number within their group.
+// Without partition expressions, all rows make a single group.
+func (b *selectBuilder) Top(partition []string, order string, n int) {
+	var buf bytes.Buffer
+	if len(partition) > 0 {
+		buf.WriteString("PARTITION BY ")
+	}
+	for i, expr := range partition {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(expr)
+	}
+	if len(partition) > 0 {
+		buf.WriteRune(' ')
+	}
+	buf.WriteString("ORDER BY ")
+	buf.WriteString(order)
+
+	b.top = n
+	b.topOver = buf.String()
+}
+
+// Page keeps only the first n rows as ordered by cols of the table aliased
+// as table, which must make a key, skipping the rows up to the one whose
+// cols hold after, if after is not nil.
+// Unlike the other methods, it may be called again between queries,
+// to read the following pages from the last row of each.
+func (b *selectBuilder) Page(table string, cols []string, after []interface{}, n int) {
+	b.after = b.after[:0]
+	for _, col := range cols {
+		b.after = append(b.after, b.Qualified(table, col))
+	}
+	b.afterKey = after
+	b.Top(nil, strings.Join(b.after, ", "), n)
+}
+
+// Qualified returns col of the table aliased as table, quoted
+func (b *selectBuilder) Qualified(table, col string) string {
+	return b.dialect.QuoteIdent(table) + "." + b.dialect.QuoteIdent(col)
+}
+
+// Bind adds an argument to the query, returning its placeholder
+func (b *selectBuilder) Bind(arg interface{}) string {
+	b.args = append(b.args, arg)
+	return b.dialect.Bind(len(b.args))
+}
+
+// Query returns the finished statement
+func (b *selectBuilder) Query() *Query {
+	var buf bytes.Buffer
+	args := b.args
+	rowNumber := b.dialect.QuoteIdent(uniqueIdent(b.dialect, "ROW_NUMBER", b.aliases))
+	if b.top > 0 {
+		// rows are numbered in a subquery and kept by their number
+		buf.WriteString("SELECT * FROM (")
+	}
+
+	buf.WriteString("SELECT ")
+	buf.Write(b.cols.Bytes())
+	if b.top > 0 {
+		buf.WriteString(", ROW_NUMBER() OVER (" + b.topOver + ") AS " + rowNumber)
+	}
+	buf.WriteString(" FROM ")
+	buf.Write(b.from.Bytes())
+	if b.where.Len() > 0 {
+		buf.WriteString(" WHERE ")
+		buf.Write(b.where.Bytes())
+	}
+	if b.afterKey != nil {
+		if b.where.Len() > 0 {
+			buf.WriteString(" AND ")
+		} else {
+			buf.WriteString(" WHERE ")
+		}
+
+		// (a, b) > (x, y) is spelled out, as Oracle has no row comparison:
+		// a > x OR (a = x AND b > y)
+		buf.WriteRune('(')
+		for i := range b.after {
+			if i > 0 {
+				buf.WriteString(" OR ")
+			}
+			buf.WriteRune('(')
+			for j := 0; j < i; j++ {
+				args = append(args[:len(args):len(args)], b.afterKey[j])
+				buf.WriteString(b.after[j] + " = " + b.dialect.Bind(len(args)) + " AND ")
+			}
+			args = append(args[:len(args):len(args)], b.afterKey[i])
+			buf.WriteString(b.after[i] + " > " + b.dialect.Bind(len(args)))
+			buf.WriteRune(')')
+		}
+		buf.WriteRune(')')
+	}
+
+	orderBy := b.orderBy
+	if b.top > 0 {
+		args = append(args[:len(args):len(args)], b.top)
+		buf.WriteString(") " + b.dialect.QuoteIdent("TOP_ROWS"))
+		buf.WriteString(" WHERE " + rowNumber + " <= " + b.dialect.Bind(len(args)))
+		orderBy = rowNumber
+	}
+	if orderBy != "" {
+		buf.WriteString(" ORDER BY ")
+		buf.WriteString(orderBy)
+	}
+
+	return &Query{SQL: buf.String(), Args: args, Aliases: b.aliases}
+}
+
+// Subquery returns a builder for a query nested within b's, taking aliases
+// unused by b and numbering its binds after b's. The binds are b's once
+// taken back by b.Bound.
+func (b *selectBuilder) Subquery() *selectBuilder {
+	sub := newSelect(b.dialect)
+	sub.tables = b.tables
+	sub.args = b.args[:len(b.args):len(b.args)]
+	return sub
+}
+
+// Bound takes the binds of the subquery sub as b's own,
+// once the subquery is written into b
+func (b *selectBuilder) Bound(sub *selectBuilder) {
+	b.args = sub.args
+}
+
+// tableAlias returns an unused alias for table
+func (b *selectBuilder) tableAlias(table string) string {
+	alias := uniqueIdent(b.dialect, table, b.tables)
+	b.tables[alias] = table
+	return alias
+}
+
+// uniqueIdent returns name, or a variation of it when it is already used or
+// too long for the dialect
+func uniqueIdent(d *Dialect, name string, used map[string]string) string {
+	unique := name
+	max := d.MaxIdentLen
+	for n := 1; (max > 0 && len(unique) > max) || used[unique] != ""; n++ {
+		suffix := "_" + strconv.Itoa(n)
+		if max > 0 && len(name)+len(suffix) > max {
+			unique = name[:max-len(suffix)] + suffix
+		} else {
+			unique = name + suffix
+		}
+	}
+
+	return unique
+}
@@ -0,0 +1,147 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestQueryForAllQuotesAndShortens(t *testing.T) {
+	tree := &mongifylab.DependencyTree{Dialect: mongifylab.Oracle}
+	tree.Prepared.Cols = map[string][]string{
+		"LE02CIDADE":           {"CODIGO", "LEVEL"},
+		"LE01ESTADOFEDERATIVO": {"SIGLAESTADOFEDERATIVO", "NOME"},
+	}
+	tree.Prepared.PKs = map[string][]string{
+		"LE02CIDADE":           {"CODIGO"},
+		"LE01ESTADOFEDERATIVO": {"SIGLAESTADOFEDERATIVO"},
+	}
+	tree.Prepared.FKs = map[string]map[string]mongifylab.FKInfo{
+		"LE02CIDADE": {"LE01ESTADOFEDERATIVO": {Columns: []string{"LEVEL"}, ForeignColumns: []string{"SIGLAESTADOFEDERATIVO"}}},
+	}
+
+	estado := mongifylab.NewTableNode("LE01ESTADOFEDERATIVO")
+	cidade := mongifylab.NewTableNode("LE02CIDADE")
+	cidade.Embedded = append(cidade.Embedded, estado)
+
+	query := tree.QueryForAll(cidade)
+	if !strings.Contains(query.SQL, `"LE02CIDADE"."LEVEL" AS "LE02CIDADE.LEVEL"`) {
+		t.Error("reserved word not quoted:", query.SQL)
+	}
+
+	for alias, name := range query.Aliases {
+		if len(alias) > mongifylab.Oracle.MaxIdentLen {
+			t.Error("alias too long:", alias)
+		}
+		if !strings.Contains(query.SQL, `AS "`+alias+`"`) {
+			t.Error("alias not in query:", alias)
+		}
+		if alias != name && len(name) <= mongifylab.Oracle.MaxIdentLen {
+			t.Error("short name was renamed:", name, alias)
+		}
+	}
+
+	if len(query.Aliases) != 4 {
+		t.Error("expected 4 aliases, got", query.Aliases)
+	}
+}
+
+func TestQueryNxNBinds(t *testing.T) {
+	for _, test := range []struct {
+		dialect *mongifylab.Dialect
+		where   string
+	}{
+		{mongifylab.Oracle, `WHERE (("J"."A", "J"."B") IN ((:1, :2), (:3, :4)))`},
+		{mongifylab.Postgres, `WHERE (("J"."A", "J"."B") IN (($1, $2), ($3, $4)))`},
+		{mongifylab.MySQL, "WHERE ((`J`.`A`, `J`.`B`) IN ((?, ?), (?, ?)))"},
+		{mongifylab.SQLite, `WHERE (("J"."A", "J"."B") IN ((?, ?), (?, ?)))`},
+	} {
+		tree := &mongifylab.DependencyTree{Dialect: test.dialect}
+		tree.Prepared.Cols = map[string][]string{"J": {"A", "B"}}
+
+		query := tree.QueryNxN("J", []string{"A", "B"}, [][]interface{}{{1, 2}, {3, 4}})
+		if !strings.HasSuffix(query.SQL, test.where) {
+			t.Errorf("%s: unexpected query %s", test.dialect.Name, query.SQL)
+		}
+		if len(query.Args) != 4 {
+			t.Errorf("%s: expected 4 args, got %v", test.dialect.Name, query.Args)
+		}
+	}
+}
+
+func TestQueryNxNSingleParent(t *testing.T) {
+	expected := "SELECT * FROM SOCIO WHERE PESSOA = (:1) AND CLUBE = (:2)"
+	if sql := mongifylab.QueryNxN([]string{"PESSOA", "CLUBE"}, "SOCIO"); sql != expected {
+		t.Errorf("expected %s, got %s", expected, sql)
+	}
+}
+
+func TestQueryForAllDiamond(t *testing.T) {
+	tree := &mongifylab.DependencyTree{Dialect: mongifylab.SQLite}
+	tree.Prepared.Cols = map[string][]string{
+		"CANDIDATO": {"ID", "CIDADE", "PARTIDO"},
+		"PARTIDO":   {"ID", "CIDADE"},
+		"CIDADE":    {"ID", "NOME"},
+	}
+	tree.Prepared.PKs = map[string][]string{"CANDIDATO": {"ID"}, "PARTIDO": {"ID"}, "CIDADE": {"ID"}}
+	tree.Prepared.FKs = map[string]map[string]mongifylab.FKInfo{
+		"CANDIDATO": {
+			"CIDADE":  {Columns: []string{"CIDADE"}, ForeignColumns: []string{"ID"}},
+			"PARTIDO": {Columns: []string{"PARTIDO"}, ForeignColumns: []string{"ID"}},
+		},
+		"PARTIDO": {"CIDADE": {Columns: []string{"CIDADE"}, ForeignColumns: []string{"ID"}}},
+	}
+
+	cidade := mongifylab.NewTableNode("CIDADE")
+	partido := mongifylab.NewTableNode("PARTIDO")
+	partido.Embedded = append(partido.Embedded, cidade)
+	candidato := mongifylab.NewTableNode("CANDIDATO")
+	candidato.Embedded = append(candidato.Embedded, cidade, partido)
+
+	query := tree.QueryForAll(candidato)
+	if !strings.Contains(query.SQL, `LEFT JOIN "CIDADE" ON`) || !strings.Contains(query.SQL, `LEFT JOIN "CIDADE" "CIDADE_1" ON "PARTIDO"."CIDADE" = "CIDADE_1"."ID"`) {
+		t.Error("joins are not aliased:", query.SQL)
+	}
+
+	names := make(map[string]bool)
+	for _, name := range query.Aliases {
+		names[name] = true
+	}
+	if !names["CANDIDATO.CIDADE.NOME"] || !names["CANDIDATO.PARTIDO.CIDADE.NOME"] {
+		t.Error("columns are not named by path:", query.Aliases)
+	}
+}
+
+func TestQueryForAllFilter(t *testing.T) {
+	const long = "LE99PESSOASCOMNOMESMUITOLONGOS"
+	for _, test := range []struct {
+		dialect *mongifylab.Dialect
+		table   string
+		where   string
+		sample  float64
+		from    string
+	}{
+		{mongifylab.Oracle, "PESSOA", "IDADE > 18", 10, `FROM "PESSOA" SAMPLE (10) WHERE (IDADE > 18)`},
+		{mongifylab.Oracle, long + "X", "", 2.5, `FROM "` + long + `X" SAMPLE (2.5) "LE99PESSOASCOMNOMESMUITOLONG_1"`},
+		{mongifylab.Oracle, "PESSOA", "IDADE > 18", 0, `FROM "PESSOA" WHERE (IDADE > 18)`},
+		{mongifylab.Postgres, "PESSOA", "IDADE > 18", 10, `FROM "PESSOA" TABLESAMPLE BERNOULLI (10) WHERE (IDADE > 18)`},
+		{mongifylab.Postgres, "PESSOA", "", 100, `FROM "PESSOA"`},
+		{mongifylab.MySQL, "PESSOA", "IDADE > 18", 10, "FROM `PESSOA` WHERE (RAND() * 100 < 10) AND (IDADE > 18)"},
+		{mongifylab.MySQL, "PESSOA", "", 10, "FROM `PESSOA` WHERE (RAND() * 100 < 10)"},
+		{mongifylab.SQLite, "PESSOA", "IDADE > 18", 10, `FROM "PESSOA" WHERE (ABS(RANDOM() % 10000) < 10 * 100) AND (IDADE > 18)`},
+		{mongifylab.SQLite, "PESSOA", "IDADE > 18", 0, `FROM "PESSOA" WHERE (IDADE > 18)`},
+	} {
+		tree := &mongifylab.DependencyTree{Dialect: test.dialect, NxN: make(map[string]*mongifylab.TableNode)}
+		tree.Prepared.Tables = []string{test.table}
+		tree.Prepared.Cols = map[string][]string{test.table: {"ID"}}
+		tree.Prepared.PKs = map[string][]string{test.table: {"ID"}}
+		tree.Add(test.table, mongifylab.SimpleTransform)
+		tree.SetFilter(test.table, test.where, test.sample)
+
+		query := tree.QueryForAll(tree.Root[0])
+		if !strings.HasSuffix(query.SQL, test.from) {
+			t.Errorf("%s: expected the query to end with %s, got %s", test.dialect.Name, test.from, query.SQL)
+		}
+	}
+}
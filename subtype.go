@@ -0,0 +1,153 @@
+package mongifylab
+
+import (
+	"fmt"
+	"strings"
+)
+
+// discriminatorField returns the field telling subtypes apart
+func (t *DependencyTree) discriminatorField() string {
+	if t.DiscriminatorField != "" {
+		return t.DiscriminatorField
+	}
+	return "_type"
+}
+
+// discriminator returns the value of the discriminator field telling apart
+// the documents of table, as a subtype or as a supertype of no subtype
+func (t *DependencyTree) discriminator(table string) string {
+	if added := t.added(table); added != nil && added.Discriminator != "" {
+		return added.Discriminator
+	}
+	return table
+}
+
+// isSubtype tells whether table is written into the documents of a supertype
+func (t *DependencyTree) isSubtype(table string) bool {
+	added := t.added(table)
+	return added != nil && added.Mode == SubtypeTransform
+}
+
+// subtypeColumns returns a variant column for each subtype of table at path,
+// holding its columns to be flattened into the documents, but the key
+// they share with table
+func (t *DependencyTree) subtypeColumns(db Querier, table *TableNode, path string) []*BsonColumn {
+	var variants []*BsonColumn
+	for _, subtype := range table.Subtypes {
+		subtypePath := path + "." + subtype.Name
+		key := t.Prepared.FKs[subtype.Name][table.Name].Columns
+
+		variant := NewColumn(subtype.Name, subtype.Name)
+		variant.Path = subtypePath
+		variant.variant = t.discriminator(subtype.Name)
+		for _, c := range t.prepareColumns(db, subtype, subtypePath, true) {
+			if c.Table != subtype.Name || c.Path != subtypePath || !containsString(key, c.Name) {
+				variant.InnerColumns = append(variant.InnerColumns, c)
+			}
+		}
+		variants = append(variants, variant)
+	}
+
+	return variants
+}
+
+// discriminatorColumn returns the column telling apart the variants of the
+// documents of table, the ones of no subtype by its own discriminator
+func (t *DependencyTree) discriminatorColumn(table string, variants []*BsonColumn) *BsonColumn {
+	field := t.discriminatorField()
+	c := NewColumn(table, field)
+	c.value = t.discriminator(table)
+	c.variants = variants
+	return c
+}
+
+// variantOf returns the discriminator of the deepest of variants whose row
+// is found in m, empty if none is
+func (t *DependencyTree) variantOf(variants []*BsonColumn, m map[string]interface{}) string {
+	for _, variant := range variants {
+		pks := t.Prepared.PKs[variant.Table]
+		if len(pks) == 0 || m[variant.Path+"."+pks[0]] == nil {
+			continue
+		}
+
+		if inner := t.variantOf(innerVariants(variant), m); inner != "" {
+			return inner
+		}
+		return variant.variant
+	}
+
+	return ""
+}
+
+// checkVariants returns an error if the row m, or a row of the inner
+// columns or arrays of cols, is of more than one subtype, as a document
+// has a single discriminator
+func (t *DependencyTree) checkVariants(cols []*BsonColumn, m map[string]interface{}) error {
+	for _, c := range cols {
+		if len(c.variants) > 0 {
+			if err := t.checkOverlap(c.variants, m); err != nil {
+				return err
+			}
+		}
+
+		rows := []map[string]interface{}{m}
+		if c.IsArray {
+			key, _ := t.arrayKey(c, m)
+			rows = c.lookup[key]
+		}
+		for _, row := range rows {
+			if err := t.checkVariants(c.InnerColumns, row); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkOverlap returns an error if the rows of more than one of variants,
+// or of their own subtypes, are found in m
+func (t *DependencyTree) checkOverlap(variants []*BsonColumn, m map[string]interface{}) error {
+	var found *BsonColumn
+	for _, variant := range variants {
+		pks := t.Prepared.PKs[variant.Table]
+		if len(pks) == 0 || m[variant.Path+"."+pks[0]] == nil {
+			continue
+		}
+
+		if found != nil {
+			var key []string
+			for _, pk := range pks {
+				key = append(key, pk+": "+valueString(m[variant.Path+"."+pk]))
+			}
+			return fmt.Errorf("row {%s} is both %s and %s, but subtypes may not overlap", strings.Join(key, ", "), found.Table, variant.Table)
+		}
+		found = variant
+	}
+
+	if found == nil {
+		return nil
+	}
+	return t.checkOverlap(innerVariants(found), m)
+}
+
+// innerVariants returns the variant columns among the inner ones of c
+func innerVariants(c *BsonColumn) []*BsonColumn {
+	var variants []*BsonColumn
+	for _, inner := range c.InnerColumns {
+		if inner.variant != "" {
+			variants = append(variants, inner)
+		}
+	}
+	return variants
+}
+
+// variantValues returns the discriminators the documents of variant may
+// have, its own and the ones of its subtypes
+func variantValues(variant *BsonColumn) []string {
+	values := []string{variant.variant}
+	for _, inner := range innerVariants(variant) {
+		values = append(values, variantValues(inner)...)
+	}
+	return values
+}
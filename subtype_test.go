@@ -0,0 +1,78 @@
+package mongifylab_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestSubtypes(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t, "CANDIDATO", "ELEITOR")
+	defer sqlite.Close()
+
+	if _, err := sqlite.Exec(`
+	INSERT INTO CANDIDATO VALUES (1, 13);
+	INSERT INTO ELEITOR VALUES (2, '0042');`); err != nil {
+		t.Fatal(err)
+	}
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"PESSOA":    mongifylab.SimpleTransform,
+		"CANDIDATO": mongifylab.SubtypeTransform,
+		"ELEITOR":   mongifylab.SubtypeTransform,
+	})
+	tree.SetDiscriminator("ELEITOR", "eleitor")
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		`{_id: {ID: 1}, _type: "CANDIDATO", NOME: "Ana", CIDADE: 1, NUMERO: 13}`,
+		`{_id: {ID: 2}, _type: "eleitor", NOME: "Bia", CIDADE: 1, TITULO: "0042"}`,
+	} {
+		if !strings.Contains(script, expected) {
+			t.Errorf("missing %s in:\n%s", expected, script)
+		}
+	}
+	if strings.Contains(script, "db.CANDIDATO") {
+		t.Error("expected no collection of subtypes in:\n", script)
+	}
+
+	validator, err := tree.CreateValidatorScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `_type: {enum: ["PESSOA", "CANDIDATO", "eleitor"]}, NOME: {}, CIDADE: {}}, oneOf: [` +
+		`{properties: {_type: {enum: ["PESSOA"]}}}, ` +
+		`{bsonType: "object", properties: {_type: {enum: ["CANDIDATO"]}, NUMERO: {}}}, ` +
+		`{bsonType: "object", properties: {_type: {enum: ["eleitor"]}, TITULO: {}}}]`
+	if !strings.Contains(validator, expected) {
+		t.Errorf("missing %s in:\n%s", expected, validator)
+	}
+
+	tree.DiscriminatorField = "tipo"
+	if _, err := sqlite.Exec(`DELETE FROM CANDIDATO`); err != nil {
+		t.Fatal(err)
+	}
+	script, err = tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `{_id: {ID: 1}, tipo: "PESSOA", NOME: "Ana", CIDADE: 1}`; !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+
+	mapping := tree.Mapping()
+	if mapping.Discriminator != "tipo" || mapping.Tables[1].Discriminator != "eleitor" || mapping.Tables[0].Mode != mongifylab.SubtypeTransform {
+		t.Errorf("expected the subtypes in the mapping, got %+v", mapping)
+	}
+
+	// a row of both subtypes would have a single discriminator
+	if _, err := sqlite.Exec(`INSERT INTO CANDIDATO VALUES (2, 45)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tree.CreateCollectionScript(sqlite); err == nil || !strings.Contains(err.Error(), "is both CANDIDATO and ELEITOR") {
+		t.Error("expected overlapping subtypes to be refused, got", err)
+	}
+}
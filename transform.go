@@ -15,12 +15,30 @@ type DependencyTree struct {
 
 	NxN map[string]*TableNode
 
+	// Dialect of the source database, Oracle if nil
+	Dialect *Dialect
+
+	// Naming is how collections and fields are named,
+	// unless a table is named otherwise
+	Naming Naming
+
+	// References is how documents refer to the ones of other tables
+	References ReferenceFormat
+
+	// DiscriminatorField is the field telling the subtypes written into
+	// the same documents apart, "_type" if empty
+	DiscriminatorField string
+
+	// Hooks are the hooks computed fields may be computed by, by name
+	Hooks map[string]Hook
+
 	Prepared struct {
 		Tables []string
 		Cols   map[string][]string          // Cols[TableName] = [Cols...]
 		PKs    map[string][]string          // PKs[TableName] = [PkCols...]
 		UNs    map[string][][]string        // UNs[TableName] = [[UNCols...]]
 		FKs    map[string]map[string]FKInfo // FKs[TableName][ForeignTable] = [ForeignKeys...]
+		Types  map[string]map[string]string // Types[TableName][Col] = DataType
 	}
 }
 
@@ -29,11 +47,124 @@ type TableNode struct {
 	Embedded   []*TableNode
 	Referenced []string
 	NxNProxy   []*TableNode
+
+	// Arrays are the tables whose rows referring to this one
+	// are embedded as an array of documents
+	Arrays []*TableNode
+
+	// Subtypes are the tables sharing the primary key of this one
+	// whose rows are written into its documents as variants
+	Subtypes []*TableNode
+
+	// FarSide is the table an NxN proxy relates its owner to,
+	// empty if there is none
+	FarSide string
 }
 
 type AddedTable struct {
 	Table *TableNode
 	Mode  TransformMode
+
+	// Where is an SQL predicate the extracted rows must match,
+	// columns may be qualified by the table name
+	Where string
+
+	// Sample is the percentage of rows to extract,
+	// zero (or 100) extracts all of them
+	Sample float64
+
+	// ChangeColumn tells when each row last changed, e.g. a timestamp or
+	// a version number, so that only changed rows are extracted again
+	ChangeColumn string
+
+	// HighWaterMark is the highest value of ChangeColumn extracted so far,
+	// nil if the table was never extracted
+	HighWaterMark interface{}
+
+	// Rename names the fields of the table's documents differently from
+	// their columns, Rename[Column] = Field. Embedded and referenced
+	// tables, as well as NxN arrays, are renamed by the table name.
+	Rename map[string]string
+
+	// Include lists the only columns kept in the documents, besides the
+	// primary key, all of them are if empty
+	Include []string
+
+	// Exclude lists the columns left out of the documents
+	Exclude []string
+
+	// Naming names the fields of the table instead of the tree's Naming,
+	// if not nil
+	Naming *Naming
+
+	// Collection is the name of the table's collection, if not empty
+	Collection string
+
+	// OrderBy is an SQL expression the rows of an array table are
+	// ordered by in its arrays, columns may be qualified by the table name
+	OrderBy string
+
+	// MaxItems is the most rows an array of an array table holds,
+	// zero holds all of them
+	MaxItems int
+
+	// Parent is the table whose documents hold the arrays of an array
+	// table, among the ones it refers to. Empty picks the first top entity
+	// that is not referenced, or else the first table that may hold arrays.
+	Parent string
+
+	// FarSide is the table an NxN table relates its owner to, for junctions
+	// relating more than two tables. Empty picks the first one.
+	FarSide string
+
+	// FarMode is whether the arrays of an NxN table embed a copy of the
+	// far side (EmbeddedTransform) or reference it (ReferencedTransform),
+	// zero follows the mode of the far side table
+	FarMode TransformMode
+
+	// Computed lists the fields added to the documents, computed from each row
+	Computed []ComputedField
+
+	// Extend lists the columns of a referenced table copied into the
+	// references to it, alongside its primary key
+	Extend []string
+
+	// Prefix is the field the columns of a merged table are flattened
+	// under, they are flattened at the top level if empty, where no field
+	// may clash with the ones the documents have already
+	Prefix string
+
+	// Discriminator tells the documents of a subtype table apart, or the
+	// ones of a supertype of no subtype, the table name if empty
+	Discriminator string
+
+	// LookupColumn is the column of a lookup table written in place of the
+	// references to it, its first column out of the primary key if empty
+	LookupColumn string
+
+	// Enum has validators allow only the values of the lookup column
+	// found in a lookup table
+	Enum bool
+
+	// AttributeKey and AttributeValue are the columns of an attribute table
+	// holding the name and the value of each attribute, the first two
+	// out of its foreign keys if empty
+	AttributeKey   string
+	AttributeValue string
+
+	// AttributeArray writes the attributes as an array of {k, v} documents,
+	// instead of an object keyed by name
+	AttributeArray bool
+
+	// BucketSize, BucketColumn and BucketWindow group the rows of an array
+	// table into buckets instead of arrays, see SetBucket
+	BucketSize   int
+	BucketColumn string
+	BucketWindow string
+
+	// Overflow writes the rows of an array table beyond MaxItems
+	// to a collection of their own, see SetOverflow
+	Overflow bool
 }
 
 func NewTableNode(name string) *TableNode {
@@ -41,7 +172,7 @@ func NewTableNode(name string) *TableNode {
 }
 
 func NewDependencyTree(db *sql.DB) *DependencyTree {
-	t := &DependencyTree{}
+	t := &DependencyTree{Dialect: Oracle}
 	t.NxN = make(map[string]*TableNode)
 
 	// Prepare database data
@@ -54,6 +185,7 @@ func NewDependencyTree(db *sql.DB) *DependencyTree {
 	t.Prepared.PKs = make(map[string][]string)
 	t.Prepared.UNs = make(map[string][][]string)
 	t.Prepared.FKs = make(map[string]map[string]FKInfo)
+	t.Prepared.Types = make(map[string]map[string]string)
 	for _, table := range tables {
 		//FKs
 		pks, fks, uns, err := QueryConstraints(db, table)
@@ -68,91 +200,551 @@ func NewDependencyTree(db *sql.DB) *DependencyTree {
 		if err == nil {
 			t.Prepared.Cols[table] = cols
 		}
+		types, err := QueryColumnTypes(db, table)
+		if err == nil {
+			t.Prepared.Types[table] = types
+		}
 	}
 
 	return t
 }
 
+func (t *DependencyTree) dialect() *Dialect {
+	if t.Dialect == nil {
+		return Oracle
+	}
+	return t.Dialect
+}
+
+// added returns the added table by its name, nil if it was not added
+func (t *DependencyTree) added(name string) *AddedTable {
+	for i := range t.AddedTables {
+		if t.AddedTables[i].Table.Name == name {
+			return &t.AddedTables[i]
+		}
+	}
+	return nil
+}
+
+// SetFilter restricts the rows extracted from an added table to the ones
+// matching the SQL predicate where (if not empty) and to a sample of about
+// sample percent of them (if not zero).
+// It applies wherever the table's rows are queried on their own,
+// as a collection or as the proxy of NxN arrays.
+func (t *DependencyTree) SetFilter(table, where string, sample float64) {
+	if added := t.added(table); added != nil {
+		added.Where = where
+		added.Sample = sample
+	}
+}
+
+// SetFields renames the fields of an added table,
+// replacing the renames set before
+func (t *DependencyTree) SetFields(table string, rename map[string]string) {
+	if added := t.added(table); added != nil {
+		added.Rename = rename
+	}
+}
+
+// SetProjection keeps only the columns of an added table in include (if not
+// empty) and not in exclude in its documents, besides its primary key.
+// Columns left out are not extracted at all, unless documents are related by them.
+func (t *DependencyTree) SetProjection(table string, include, exclude []string) {
+	if added := t.added(table); added != nil {
+		added.Include = include
+		added.Exclude = exclude
+	}
+}
+
+// excluded tells whether col of table is left out of the documents
+func (t *DependencyTree) excluded(table, col string) bool {
+	added := t.added(table)
+	if added == nil || containsString(t.Prepared.PKs[table], col) {
+		return false
+	}
+
+	if len(added.Include) > 0 && !containsString(added.Include, col) {
+		return true
+	}
+	return containsString(added.Exclude, col)
+}
+
+// selectedColumns returns the columns of table extracted for its documents,
+// the ones not excluded, the ones documents are related by
+// and the ones read by hooks
+func (t *DependencyTree) selectedColumns(table string) []string {
+	keys := t.keyColumns(table)
+	for _, computed := range t.computedFields(table) {
+		keys = append(keys, computed.Columns...)
+	}
+
+	var cols []string
+	for _, col := range t.Prepared.Cols[table] {
+		if !t.excluded(table, col) || containsString(keys, col) {
+			cols = append(cols, col)
+		}
+	}
+	return cols
+}
+
+// SetArrayOptions sets how the arrays of an added array table are ordered,
+// by the SQL expression orderBy (if not empty), and the most rows each
+// one holds (if not zero)
+func (t *DependencyTree) SetArrayOptions(table, orderBy string, maxItems int) {
+	if added := t.added(table); added != nil {
+		added.OrderBy = orderBy
+		added.MaxItems = maxItems
+	}
+}
+
+// SetArrayParent sets the table whose documents hold the arrays of an
+// added array table, among the ones it refers to, empty picks one
+func (t *DependencyTree) SetArrayParent(table, parent string) {
+	if added := t.added(table); added != nil && added.Parent != parent {
+		added.Parent = parent
+		t.rebuild()
+	}
+}
+
+// SetMergePrefix sets the field the columns of an added merged table are
+// flattened under, empty flattens them at the top level
+func (t *DependencyTree) SetMergePrefix(table, prefix string) {
+	if added := t.added(table); added != nil {
+		added.Prefix = prefix
+	}
+}
+
+// SetDiscriminator sets the value of the discriminator field telling the
+// documents of an added subtype or supertype table apart
+func (t *DependencyTree) SetDiscriminator(table, discriminator string) {
+	if added := t.added(table); added != nil {
+		added.Discriminator = discriminator
+	}
+}
+
+// SetLookup sets the column of an added lookup table written in place of
+// the references to it, and whether validators allow only its values
+func (t *DependencyTree) SetLookup(table, column string, enum bool) {
+	if added := t.added(table); added != nil {
+		added.LookupColumn = column
+		added.Enum = enum
+	}
+}
+
+// merged tells whether table is merged into the tables referring to it
+func (t *DependencyTree) merged(table string) bool {
+	added := t.added(table)
+	return added != nil && added.Mode == MergeTransform
+}
+
+// SetExtendedReference copies the columns extend of an added table into the
+// references to it, so its documents need not be looked up for them
+func (t *DependencyTree) SetExtendedReference(table string, extend []string) {
+	if added := t.added(table); added != nil {
+		added.Extend = extend
+	}
+}
+
+// referenceColumns returns the columns of table written into the
+// references to it: its primary key and the ones it extends them with,
+// or the lookup column of a lookup table
+func (t *DependencyTree) referenceColumns(table string) []string {
+	if col := t.lookupColumn(table); col != "" {
+		return []string{col}
+	}
+
+	cols := append([]string(nil), t.Prepared.PKs[table]...)
+	if added := t.added(table); added != nil {
+		for _, col := range added.Extend {
+			if !containsString(cols, col) {
+				cols = append(cols, col)
+			}
+		}
+	}
+	return cols
+}
+
+// SetFarSide sets the table an added NxN table relates its owner to,
+// among the ones its primary key refers to, and whether its arrays embed
+// (EmbeddedTransform) or reference (ReferencedTransform) it.
+// A zero mode follows the mode of the far side table.
+func (t *DependencyTree) SetFarSide(table, farSide string, mode TransformMode) {
+	if added := t.added(table); added != nil && (added.FarSide != farSide || added.FarMode != mode) {
+		added.FarSide = farSide
+		added.FarMode = mode
+		t.rebuild()
+	}
+}
+
+// Reset removes every added table, back to how the tree was created
+func (t *DependencyTree) Reset() {
+	t.AddedTables = nil
+	t.rebuild()
+}
+
+// Clear removes every added table, as Reset does.
+//
+// Deprecated: use Reset.
 func (t *DependencyTree) Clear() {
-	t.Root = nil
+	t.Reset()
+}
+
+// Remove takes an added table out of the tree,
+// relating the remaining ones again
+func (t *DependencyTree) Remove(table string) {
+	for i, added := range t.AddedTables {
+		if added.Table.Name == table {
+			t.AddedTables = append(t.AddedTables[:i], t.AddedTables[i+1:]...)
+			t.rebuild()
+			return
+		}
+	}
+}
+
+// SetMode changes how an added table relates to the others
+func (t *DependencyTree) SetMode(table string, mode TransformMode) {
+	if added := t.added(table); added != nil && added.Mode != mode {
+		added.Mode = mode
+		t.rebuild()
+	}
 }
 
+// Add adds a table to the tree, to be related to the others by mode.
+// Adding a table again just changes its mode.
 func (t *DependencyTree) Add(newTableName string, mode TransformMode) {
-	newTable := NewTableNode(newTableName)
+	if added := t.added(newTableName); added != nil {
+		t.SetMode(newTableName, mode)
+		return
+	}
 
-	for _, added := range t.AddedTables {
-		t.recursiveAdd(newTable, added.Table, added.Mode, false)
+	t.AddedTables = append(t.AddedTables, AddedTable{Table: NewTableNode(newTableName), Mode: mode})
+	t.rebuild()
+}
+
+// Resolve makes the tree from the whole set of tables and their modes at once,
+// replacing the added tables. Options of the tables kept are kept as well.
+func (t *DependencyTree) Resolve(modes map[string]TransformMode) {
+	var names []string
+	for name := range modes {
+		names = append(names, name)
 	}
-	t.AddedTables = append(t.AddedTables, AddedTable{Table: newTable, Mode: mode})
+	sort.Strings(names)
 
-	// Other must know of newTable
-	if mode != SimpleTransform {
-		for _, table := range t.Root {
-			t.recursiveAdd(table, newTable, mode, true)
+	var tables []AddedTable
+	for _, name := range names {
+		table := AddedTable{Table: NewTableNode(name)}
+		if added := t.added(name); added != nil {
+			table = *added
 		}
+		table.Mode = modes[name]
+		tables = append(tables, table)
 	}
 
-	// newTable must be added as a top entity
-	if mode == SimpleTransform || mode == ReferencedTransform {
-		t.Root = append(t.Root, newTable)
-		sort.Sort(t.Root)
-	}
+	t.AddedTables = tables
+	t.rebuild()
 }
 
-func (t *DependencyTree) recursiveAdd(table *TableNode, foreignNode *TableNode, mode TransformMode, recurse bool) bool {
-	// fmt.Println("Table:", table.Name, "New Table:", foreignNode.Name, "Mode:", mode)
-	_, found := t.Prepared.FKs[table.Name][foreignNode.Name]
-	if found {
-		switch mode {
-		case ReferencedTransform:
-			table.Referenced = append(table.Referenced, foreignNode.Name)
-		case EmbeddedTransform:
-			table.Embedded = append(table.Embedded, foreignNode)
+// rebuild makes the tree again from AddedTables, with new nodes.
+// The tree depends only on the set of tables and their modes,
+// never on the order they were added in.
+func (t *DependencyTree) rebuild() {
+	t.Root = nil
+	t.NxN = make(map[string]*TableNode)
+
+	var names []string
+	nodes := make(map[string]*TableNode)
+	modes := make(map[string]TransformMode)
+	for i := range t.AddedTables {
+		node := NewTableNode(t.AddedTables[i].Table.Name)
+		t.AddedTables[i].Table = node
+		names = append(names, node.Name)
+		nodes[node.Name] = node
+		modes[node.Name] = t.AddedTables[i].Mode
+
+		// merged and attribute tables make the same tree embedded
+		// and array ones do, they are only written otherwise
+		switch modes[node.Name] {
+		case MergeTransform:
+			modes[node.Name] = EmbeddedTransform
+		case AttributeTransform:
+			modes[node.Name] = ArrayTransform
 		}
 	}
-	if mode == NxNTransform {
-		_, hasRel := t.Prepared.FKs[foreignNode.Name][table.Name]
-		if _, newNxN := t.NxN[foreignNode.Name]; hasRel && !newNxN {
-			found = true
-			for i, node := range foreignNode.Embedded {
-				if node == table {
-					foreignNode.Embedded = append(foreignNode.Embedded[:i], foreignNode.Embedded[i+1:]...)
-					break
+	sort.Strings(names)
+
+	// Simple and referenced tables are top entities
+	for _, name := range names {
+		if modes[name] == SimpleTransform || modes[name] == ReferencedTransform {
+			t.Root = append(t.Root, nodes[name])
+		}
+	}
+
+	// Every table embeds or references the tables it has foreign keys to,
+	// but array tables go into the documents of their parent
+	// and subtypes into the ones of the table they share the key of
+	for _, name := range names {
+		node := nodes[name]
+
+		var parent string
+		if modes[name] == ArrayTransform {
+			parent = t.arrayParent(name, nodes, modes)
+			if parent != "" {
+				nodes[parent].Arrays = append(nodes[parent].Arrays, node)
+			}
+		}
+
+		for _, foreign := range t.foreignTables(name) {
+			foreignNode, found := nodes[foreign]
+			if !found || foreign == parent {
+				continue
+			}
+
+			if modes[name] == SubtypeTransform && t.sharesKey(name, foreign) {
+				if modes[foreign] != NxNTransform {
+					foreignNode.Subtypes = append(foreignNode.Subtypes, node)
 				}
+				continue
 			}
 
-			for i, node := range foreignNode.Referenced {
-				if node == table.Name {
-					foreignNode.Referenced = append(foreignNode.Referenced[:i], foreignNode.Referenced[i+1:]...)
-					break
+			switch modes[foreign] {
+			case EmbeddedTransform:
+				// embedding must never lead back to the table itself
+				if !embeds(foreignNode, node) {
+					node.Embedded = append(node.Embedded, foreignNode)
 				}
+			case ReferencedTransform, LookupTransform:
+				node.Referenced = append(node.Referenced, foreign)
+			}
+		}
+	}
+
+	// NxN tables are proxies from the first top entity they relate to,
+	// or else the first embedded table reached from one,
+	// to the first other table they relate or the one asked for.
+	// Only tables their primary key refers to are related, if two or more.
+	reached := make(map[*TableNode]bool)
+	for _, root := range t.Root {
+		markEmbedded(root, reached)
+	}
+
+	for _, name := range names {
+		if modes[name] != NxNTransform {
+			continue
+		}
+
+		nxn := nodes[name]
+		sides := t.junctionSides(name)
+		if len(sides) < 2 {
+			sides = t.foreignTables(name)
+		}
+
+		var owner *TableNode
+		for _, foreign := range sides {
+			foreignNode, found := nodes[foreign]
+			if !found || modes[foreign] == NxNTransform || !reached[foreignNode] {
+				continue
 			}
 
-			for i, node := range foreignNode.NxNProxy {
-				if node == table {
-					foreignNode.NxNProxy = append(foreignNode.NxNProxy[:i], foreignNode.NxNProxy[i+1:]...)
+			isRoot := modes[foreign] != EmbeddedTransform
+			if owner == nil || (isRoot && modes[owner.Name] == EmbeddedTransform) {
+				owner = foreignNode
+			}
+		}
+
+		if owner == nil {
+			continue
+		}
+
+		// the owner is on the other side of the array,
+		// the proxy must not relate back to it
+		unrelate(nxn, owner.Name)
+
+		added := t.added(name)
+		farSide := added.FarSide
+		if farSide == owner.Name || !containsString(sides, farSide) {
+			farSide = ""
+			for _, side := range sides {
+				if side != owner.Name {
+					farSide = side
 					break
 				}
 			}
+		}
+		nxn.FarSide = farSide
+
+		// the far side is related as asked for, embedded copies of
+		// top entities leave their own arrays out
+		if far, found := nodes[farSide]; found {
+			switch added.FarMode {
+			case EmbeddedTransform:
+				unrelate(nxn, farSide)
+				nxn.Embedded = append(nxn.Embedded, &TableNode{Name: far.Name, Embedded: far.Embedded, Referenced: far.Referenced})
+			case ReferencedTransform:
+				unrelate(nxn, farSide)
+				nxn.Referenced = append(nxn.Referenced, farSide)
+			}
+		}
+
+		owner.NxNProxy = append(owner.NxNProxy, nxn)
+		t.NxN[name] = nxn
+	}
+}
+
+// arrayParent returns the table whose documents hold the arrays of the
+// array table name, the one asked for if it may hold them. Top entities
+// that are not referenced are picked first, then any other table but
+// embedded, NxN and lookup ones, in the order of foreignTables.
+// Arrays must never lead back to the table itself.
+func (t *DependencyTree) arrayParent(name string, nodes map[string]*TableNode, modes map[string]TransformMode) string {
+	mayHold := func(foreign string) bool {
+		foreignNode, found := nodes[foreign]
+		if !found || foreign == name {
+			return false
+		}
+		switch modes[foreign] {
+		case EmbeddedTransform, NxNTransform, LookupTransform:
+			return false
+		}
+		return !embeds(nodes[name], foreignNode)
+	}
+
+	if parent := t.added(name).Parent; parent != "" && mayHold(parent) {
+		if _, found := t.Prepared.FKs[name][parent]; found {
+			return parent
+		}
+	}
+
+	parent := ""
+	for _, foreign := range t.foreignTables(name) {
+		if !mayHold(foreign) {
+			continue
+		}
+		if modes[foreign] == SimpleTransform {
+			return foreign
+		}
+		if parent == "" {
+			parent = foreign
+		}
+	}
+
+	return parent
+}
+
+// parentOf returns the table whose documents hold the arrays of the array
+// table, empty if none does
+func (t *DependencyTree) parentOf(table string) string {
+	for _, added := range t.AddedTables {
+		for _, array := range added.Table.Arrays {
+			if array.Name == table {
+				return added.Table.Name
+			}
+		}
+	}
+	return ""
+}
+
+// unrelate makes node neither embed nor reference table
+func unrelate(node *TableNode, table string) {
+	for i, embedded := range node.Embedded {
+		if embedded.Name == table {
+			node.Embedded = append(node.Embedded[:i], node.Embedded[i+1:]...)
+			break
+		}
+	}
+	for i, referenced := range node.Referenced {
+		if referenced == table {
+			node.Referenced = append(node.Referenced[:i], node.Referenced[i+1:]...)
+			break
+		}
+	}
+}
+
+// sharesKey tells whether the primary key of table is made of exactly
+// the foreign key to foreign, which refers to its primary key
+func (t *DependencyTree) sharesKey(table, foreign string) bool {
+	fk := t.Prepared.FKs[table][foreign]
+	sameCols := func(cols, pks []string) bool {
+		if len(pks) == 0 || len(cols) != len(pks) {
+			return false
+		}
+		for _, col := range cols {
+			if !containsString(pks, col) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return sameCols(fk.Columns, t.Prepared.PKs[table]) && sameCols(fk.ForeignColumns, t.Prepared.PKs[foreign])
+}
+
+// junctionSides returns the tables that foreign keys of table within its
+// primary key refer to, sorted
+func (t *DependencyTree) junctionSides(table string) []string {
+	pks := t.Prepared.PKs[table]
 
-			t.NxN[foreignNode.Name] = foreignNode
-			table.NxNProxy = append(table.NxNProxy, foreignNode)
+	var sides []string
+	for _, foreign := range t.foreignTables(table) {
+		inPK := len(pks) > 0
+		for _, col := range t.Prepared.FKs[table][foreign].Columns {
+			inPK = inPK && containsString(pks, col)
+		}
+		if inPK {
+			sides = append(sides, foreign)
 		}
 	}
 
-	// if recurse {
-	for _, embedded := range table.Embedded {
-		ret := t.recursiveAdd(embedded, foreignNode, mode, true)
-		found = found || ret
+	return sides
+}
+
+// foreignTables returns the tables that table has foreign keys to, sorted
+func (t *DependencyTree) foreignTables(table string) []string {
+	var foreigns []string
+	for foreign := range t.Prepared.FKs[table] {
+		foreigns = append(foreigns, foreign)
 	}
-	// }
+	sort.Strings(foreigns)
 
-	for _, nxn := range table.NxNProxy {
-		ret := t.recursiveAdd(nxn, foreignNode, mode, true)
-		found = found || ret
+	return foreigns
+}
+
+// embeds tells whether node is table or embeds it, however deep,
+// as an object or in its arrays
+func embeds(node, table *TableNode) bool {
+	if node == table {
+		return true
+	}
+	for _, embedded := range node.Embedded {
+		if embeds(embedded, table) {
+			return true
+		}
+	}
+	for _, array := range node.Arrays {
+		if embeds(array, table) {
+			return true
+		}
 	}
+	return false
+}
+
+// markEmbedded marks node and every table it embeds, however deep
+func markEmbedded(node *TableNode, marked map[*TableNode]bool) {
+	marked[node] = true
+	for _, embedded := range node.Embedded {
+		markEmbedded(embedded, marked)
+	}
+	for _, subtype := range node.Subtypes {
+		markEmbedded(subtype, marked)
+	}
+}
 
-	return found
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
 }
 
 // TableNodes implements sort.Interface
@@ -186,4 +778,27 @@ const (
 
 	// NxNTransform adds it as a proxy between two other tables
 	NxNTransform
+
+	// ArrayTransform embeds its rows into the tables they refer to,
+	// as an array of documents
+	ArrayTransform
+
+	// MergeTransform inlines it into other tables as EmbeddedTransform
+	// does, but flattens its columns into theirs, for tables split
+	// in two sharing the primary key
+	MergeTransform
+
+	// SubtypeTransform writes its rows into the documents of the table
+	// it shares the primary key with, as a variant told apart by the
+	// discriminator field. Rows of more than one subtype are refused.
+	SubtypeTransform
+
+	// LookupTransform writes a single column of it in place of the
+	// references to it, for code tables
+	LookupTransform
+
+	// AttributeTransform embeds its rows into the tables they refer to,
+	// as ArrayTransform does, but as the attributes of an
+	// entity-attribute-value table, by name and value
+	AttributeTransform
 )
@@ -0,0 +1,149 @@
+package mongifylab_test
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"testing/quick"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestRemoveAndSetMode(t *testing.T) {
+	tree := newElectionTree()
+	tree.Add("ESTADO", mongifylab.EmbeddedTransform)
+	tree.Add("CIDADE", mongifylab.ReferencedTransform)
+	tree.Add("PARTIDO", mongifylab.EmbeddedTransform)
+	tree.Add("CANDIDATO", mongifylab.SimpleTransform)
+	tree.SetFilter("CANDIDATO", "ID > 10", 0)
+
+	expected := newElectionTree()
+	expected.Add("ESTADO", mongifylab.EmbeddedTransform)
+	expected.Add("PARTIDO", mongifylab.ReferencedTransform)
+	expected.Add("CANDIDATO", mongifylab.SimpleTransform)
+
+	tree.Remove("CIDADE")
+	tree.SetMode("PARTIDO", mongifylab.ReferencedTransform)
+	if shape(tree) != shape(expected) {
+		t.Errorf("expected:\n%s\ngot:\n%s", shape(expected), shape(tree))
+	}
+
+	if tree.AddedTables[2].Where != "ID > 10" {
+		t.Error("options were lost:", tree.AddedTables[2])
+	}
+
+	tree.Reset()
+	if len(tree.Root) > 0 || len(tree.AddedTables) > 0 || len(tree.NxN) > 0 {
+		t.Error("tree was not reset:", shape(tree))
+	}
+
+	tree.Add("CIDADE", mongifylab.SimpleTransform)
+	tree.Clear()
+	if len(tree.Root) > 0 || len(tree.AddedTables) > 0 {
+		t.Error("tree was not cleared:", shape(tree))
+	}
+}
+
+func TestResolveIsOrderIndependent(t *testing.T) {
+	tables := newElectionTree().Prepared.Tables
+	modes := []mongifylab.TransformMode{
+		mongifylab.SimpleTransform,
+		mongifylab.EmbeddedTransform,
+		mongifylab.ReferencedTransform,
+		mongifylab.NxNTransform,
+		mongifylab.ArrayTransform,
+	}
+
+	// any modes, added in any order, make the same tree
+	property := func(choices []uint8, seed int64) bool {
+		assignment := make(map[string]mongifylab.TransformMode)
+		for i, table := range tables {
+			if i < len(choices) {
+				assignment[table] = modes[int(choices[i])%len(modes)]
+			} else {
+				assignment[table] = mongifylab.SimpleTransform
+			}
+		}
+
+		inOrder := newElectionTree()
+		for _, table := range tables {
+			inOrder.Add(table, assignment[table])
+		}
+
+		shuffled := newElectionTree()
+		for _, i := range rand.New(rand.NewSource(seed)).Perm(len(tables)) {
+			shuffled.Add(tables[i], assignment[tables[i]])
+		}
+
+		resolved := newElectionTree()
+		resolved.Resolve(assignment)
+
+		return shape(inOrder) == shape(shuffled) && shape(inOrder) == shape(resolved)
+	}
+
+	if err := quick.Check(property, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestResolveNxN(t *testing.T) {
+	tree := newElectionTree()
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO":      mongifylab.EmbeddedTransform,
+		"CIDADE":      mongifylab.EmbeddedTransform,
+		"PARTIDO":     mongifylab.EmbeddedTransform,
+		"CANDIDATO":   mongifylab.ReferencedTransform,
+		"CARGO":       mongifylab.ReferencedTransform,
+		"PLEITO":      mongifylab.ReferencedTransform,
+		"CANDIDATURA": mongifylab.NxNTransform,
+	})
+
+	expected := `CANDIDATO
+	CIDADE
+		ESTADO
+	PARTIDO
+		CIDADE
+			ESTADO
+	(N:N CARGO)
+	CANDIDATURA
+		-> CARGO
+		-> PLEITO
+CARGO
+PLEITO
+`
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+
+	tree.SetFarSide("CANDIDATURA", "PLEITO", mongifylab.EmbeddedTransform)
+	expected = strings.Replace(expected, `	(N:N CARGO)
+	CANDIDATURA
+		-> CARGO
+		-> PLEITO
+`, `	(N:N PLEITO)
+	CANDIDATURA
+		PLEITO
+		-> CARGO
+`, 1)
+	if shape(tree) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, shape(tree))
+	}
+}
+
+func TestRenameAndExclude(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetFields("PESSOA", map[string]string{"NOME": "nome", "CIDADE": "cidade", "SOCIO": "clubes"})
+	tree.SetProjection("CIDADE", nil, []string{"NOME"})
+
+	script, err := tree.CreateCollectionScript(sqlite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{_id: {ID: 1}, nome: "Ana", cidade: {ID: 1, ESTADO: {SIGLA: "SP", NOME: "Sao Paulo"}}}`
+	if !strings.Contains(script, expected) {
+		t.Errorf("missing %s in:\n%s", expected, script)
+	}
+}
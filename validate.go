@@ -0,0 +1,348 @@
+package mongifylab
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Severity tells whether an issue stops the scripts from being generated
+type Severity int
+
+const (
+	// Warning is an issue the scripts may be generated with,
+	// though likely not as meant
+	Warning Severity = iota
+
+	// Error is an issue that makes the scripts wrong
+	Error
+)
+
+func (s Severity) String() string {
+	if s == Error {
+		return "error"
+	}
+	return "warning"
+}
+
+// Issue is something wrong with how a table is mapped
+type Issue struct {
+	Severity Severity
+	Table    string
+	Message  string
+}
+
+func (i Issue) String() string {
+	return fmt.Sprintf("%v: %s: %s", i.Severity, i.Table, i.Message)
+}
+
+// HasErrors tells whether any of issues is an Error
+func HasErrors(issues []Issue) bool {
+	for _, issue := range issues {
+		if issue.Severity == Error {
+			return true
+		}
+	}
+	return false
+}
+
+// ValidationError is returned instead of the scripts of a mapping
+// Validate finds errors in
+type ValidationError struct {
+	Issues []Issue
+}
+
+func (err *ValidationError) Error() string {
+	var errors []string
+	for _, issue := range err.Issues {
+		if issue.Severity == Error {
+			errors = append(errors, issue.Table+": "+issue.Message)
+		}
+	}
+	return "mapping has errors: " + strings.Join(errors, "; ")
+}
+
+// checkValid returns a *ValidationError if Validate finds errors
+// in the mapping, nil otherwise
+func (t *DependencyTree) checkValid() error {
+	if issues := t.Validate(); HasErrors(issues) {
+		return &ValidationError{Issues: issues}
+	}
+	return nil
+}
+
+// Validate checks the mapping before the scripts are generated, returning
+// its issues sorted by table. Scripts are not generated if any of
+// them is an Error, see ValidationError.
+func (t *DependencyTree) Validate() []Issue {
+	var issues []Issue
+	issue := func(severity Severity, table, format string, args ...interface{}) {
+		issues = append(issues, Issue{Severity: severity, Table: table, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// the tables the documents hold
+	reached := make(map[*TableNode]bool)
+	for _, root := range t.Root {
+		markHeld(root, reached)
+	}
+	for _, nxn := range t.NxN {
+		markHeld(nxn, reached)
+	}
+
+	tables := append([]string(nil), t.Prepared.Tables...)
+	sort.Strings(tables)
+	for _, table := range tables {
+		added := t.added(table)
+		if added == nil {
+			issue(Warning, table, "not mapped, it is left out of the documents")
+			continue
+		}
+
+		pks := t.Prepared.PKs[table]
+		switch added.Mode {
+		case SimpleTransform, ReferencedTransform:
+			if len(pks) == 0 {
+				issue(Error, table, "no primary key, its documents would have an empty _id")
+			}
+
+		case EmbeddedTransform, MergeTransform:
+			if !reached[added.Table] {
+				issue(Warning, table, "embedded, but no mapped table it is embedded into is reached from a collection")
+			}
+
+		case NxNTransform:
+			if len(t.Prepared.FKs[table]) < 2 {
+				issue(Error, table, "N x N, but it has %s instead of two or more", plural(len(t.Prepared.FKs[table]), "foreign key"))
+			} else if t.NxN[table] == nil {
+				issue(Warning, table, "N x N, but none of the tables it relates is reached from a collection")
+			} else if added.FarSide != "" && added.FarSide != t.NxN[table].FarSide {
+				issue(Error, table, "N x N to %s, but its primary key relates no such table to its owner", added.FarSide)
+			}
+			if added.FarMode != 0 && added.FarMode != EmbeddedTransform && added.FarMode != ReferencedTransform {
+				issue(Error, table, "N x N arrays may only embed or reference the far side, not be %v", added.FarMode)
+			}
+
+		case LookupTransform:
+			if !containsString(t.Prepared.Cols[table], t.lookupColumn(table)) {
+				issue(Error, table, "lookup of unknown column %s", added.LookupColumn)
+			} else if !isReferenced(table, reached) {
+				issue(Warning, table, "lookup, but no document reached from a collection refers to it")
+			}
+
+		case SubtypeTransform:
+			if !reached[added.Table] {
+				issue(Warning, table, "subtype, but no mapped table it shares the primary key with is reached from a collection")
+			}
+
+		case ArrayTransform, AttributeTransform:
+			if key, value := t.attributeColumns(table); added.Mode == AttributeTransform &&
+				(!containsString(t.Prepared.Cols[table], key) || !containsString(t.Prepared.Cols[table], value)) {
+				issue(Error, table, "attributes, but it has no columns for their names and values")
+			}
+			if added.Parent != "" && t.parentOf(table) != added.Parent {
+				issue(Error, table, "array of %s, but it does not refer to it or it holds no arrays", added.Parent)
+			} else if !reached[added.Table] {
+				issue(Warning, table, "array, but none of the tables it refers to is reached from a collection")
+			}
+
+			if _, found := BucketWindows[added.BucketWindow]; added.BucketWindow != "" && !found {
+				issue(Error, table, "buckets by unknown window %s", added.BucketWindow)
+			}
+			if added.BucketColumn != "" && !containsString(t.Prepared.Cols[table], added.BucketColumn) {
+				issue(Error, table, "buckets by unknown column %s", added.BucketColumn)
+			}
+			switch {
+			case !added.Overflow:
+			case t.bucketed(table):
+				issue(Warning, table, "both bucketed and overflowing, its rows are only bucketed")
+			case added.MaxItems <= 0:
+				issue(Error, table, "overflows, but its arrays hold any number of rows")
+			case len(pks) == 0:
+				issue(Error, table, "overflows, but no primary key identifies the documents of its overflow")
+			case added.OrderBy == "":
+				issue(Warning, table, "overflows, but its arrays are not ordered, the rows they keep are arbitrary")
+			}
+		}
+
+		if added.ChangeColumn != "" {
+			switch kind := columnKind(t.Prepared.Types[table][added.ChangeColumn]); {
+			case !containsString(t.Prepared.Cols[table], added.ChangeColumn):
+				issue(Error, table, "tracks changes by unknown column %s", added.ChangeColumn)
+			case kind == "date" || kind == "timestamp":
+				issue(Warning, table, "tracks changes by the time in %s, rows committed after a delta with an earlier time are missed by the next", added.ChangeColumn)
+			}
+		}
+
+		if len(added.Extend) > 0 && !isReferenced(table, reached) {
+			issue(Warning, table, "extends its references, but no document reached from a collection refers to it")
+		}
+
+		for _, computed := range added.Computed {
+			if err := t.checkComputed(table, computed); err != nil {
+				issue(Error, table, "%v", err)
+			} else if _, found := t.Hooks[computed.Hook]; computed.Hook != "" && !found {
+				issue(Error, table, "computed field %s needs hook %s, which is not registered", computed.Field, computed.Hook)
+			}
+		}
+
+		for _, foreign := range t.foreignTables(table) {
+			foreignAdded := t.added(foreign)
+			if foreignAdded == nil {
+				continue
+			}
+
+			fk := t.Prepared.FKs[table][foreign]
+			if t.isAmbiguous(fk, foreign) {
+				issue(Error, table, "more than one foreign key to %s, they cannot be told apart", foreign)
+				continue
+			}
+
+			mode := foreignAdded.Mode
+			if added.Mode == NxNTransform && added.FarMode != 0 && foreign == added.Table.FarSide {
+				// the far side of an NxN table is related as asked for
+				mode = added.FarMode
+				if mode == EmbeddedTransform {
+					continue
+				}
+			}
+
+			switch mode {
+			case MergeTransform:
+				if !t.sharesKey(table, foreign) {
+					issue(Warning, table, "merges %s, but they do not share the primary key, its columns may repeat", foreign)
+				}
+				if field := t.mergedClash(table, foreign); field != "" && foreignAdded.Prefix == "" {
+					issue(Error, table, "merges %s, whose field %s it has already, it needs a prefix or a rename", foreign, field)
+				}
+				fallthrough
+			case EmbeddedTransform:
+				// the owner of an NxN array is not embedded into it
+				if !containsNode(added.Table.Embedded, foreignAdded.Table) && !t.ownsNxN(foreignAdded.Table, table) {
+					issue(Warning, table, "cannot embed %s, it would embed %s back in a cycle", foreign, table)
+				}
+			case ReferencedTransform:
+				if len(t.Prepared.PKs[foreign]) == 0 {
+					issue(Error, table, "references %s, which has no primary key", foreign)
+				}
+			}
+		}
+	}
+
+	return issues
+}
+
+// mergedClash returns a field that merged flattens into the documents of
+// table, along with the tables it merges in turn, which table has already
+// from its own columns or from the ones merged before it, empty if none
+func (t *DependencyTree) mergedClash(table, merged string) string {
+	fields := make(map[string]bool)
+	for _, col := range t.Prepared.Cols[table] {
+		fields[t.fieldName(table, col, false)] = true
+	}
+	for _, foreign := range t.foreignTables(table) {
+		if foreign == merged {
+			break
+		}
+		if t.flattened(foreign) {
+			for _, field := range t.mergedFields(table, foreign, nil) {
+				fields[field] = true
+			}
+		}
+	}
+
+	for _, field := range t.mergedFields(table, merged, nil) {
+		if fields[field] {
+			return field
+		}
+	}
+	return ""
+}
+
+// flattened tells whether table is merged without a prefix
+func (t *DependencyTree) flattened(table string) bool {
+	added := t.added(table)
+	return added != nil && added.Mode == MergeTransform && added.Prefix == ""
+}
+
+// mergedFields returns the fields merged flattens into the documents of
+// table, leaving out the key they are joined by, along with the ones of
+// the tables it flattens in turn. Tables in seen are not gone into again.
+func (t *DependencyTree) mergedFields(table, merged string, seen map[string]bool) []string {
+	if seen == nil {
+		seen = map[string]bool{table: true}
+	}
+	if seen[merged] {
+		return nil
+	}
+	seen[merged] = true
+
+	var fields []string
+	key := t.Prepared.FKs[table][merged].ForeignColumns
+	for _, col := range removeDuplicate(t.Prepared.Cols[merged], key) {
+		fields = append(fields, t.fieldName(merged, col, false))
+	}
+	for _, foreign := range t.foreignTables(merged) {
+		if t.flattened(foreign) {
+			fields = append(fields, t.mergedFields(merged, foreign, seen)...)
+		}
+	}
+	return fields
+}
+
+// isAmbiguous tells whether fk is made of several foreign keys to the same
+// table, merged as they are known by the table they refer to
+func (t *DependencyTree) isAmbiguous(fk FKInfo, foreign string) bool {
+	seen := make(map[string]bool)
+	for _, col := range fk.ForeignColumns {
+		if seen[col] {
+			return true
+		}
+		seen[col] = true
+	}
+
+	pks := t.Prepared.PKs[foreign]
+	return len(pks) > 0 && len(fk.ForeignColumns) > len(pks)
+}
+
+// ownsNxN tells whether node has the NxN table as one of its arrays
+func (t *DependencyTree) ownsNxN(node *TableNode, nxn string) bool {
+	for _, proxy := range node.NxNProxy {
+		if proxy.Name == nxn {
+			return true
+		}
+	}
+	return false
+}
+
+// isReferenced tells whether any of the nodes held refers to table
+func isReferenced(table string, held map[*TableNode]bool) bool {
+	for node := range held {
+		if containsString(node.Referenced, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// markHeld marks node and every table its documents hold, however deep
+func markHeld(node *TableNode, marked map[*TableNode]bool) {
+	marked[node] = true
+	for _, embedded := range node.Embedded {
+		markHeld(embedded, marked)
+	}
+	for _, array := range node.Arrays {
+		markHeld(array, marked)
+	}
+	for _, subtype := range node.Subtypes {
+		markHeld(subtype, marked)
+	}
+}
+
+func containsNode(nodes []*TableNode, node *TableNode) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,95 @@
+package mongifylab_test
+
+import (
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestValidate(t *testing.T) {
+	tree := newElectionTree()
+	tree.Prepared.Tables = append(tree.Prepared.Tables, "ELEITOR")
+	tree.Prepared.FKs["ESTADO"] = map[string]mongifylab.FKInfo{
+		"CIDADE": {Columns: []string{"CAPITAL"}, ForeignColumns: []string{"ID"}},
+	}
+	tree.Prepared.FKs["PARTIDO"]["CANDIDATO"] = mongifylab.FKInfo{
+		Columns:        []string{"PRESIDENTE", "TESOUREIRO"},
+		ForeignColumns: []string{"ID", "ID"},
+	}
+	delete(tree.Prepared.FKs["CANDIDATO"], "PARTIDO")
+	delete(tree.Prepared.PKs, "CARGO")
+
+	tree.Resolve(map[string]mongifylab.TransformMode{
+		"ESTADO":      mongifylab.EmbeddedTransform,
+		"CIDADE":      mongifylab.EmbeddedTransform,
+		"PARTIDO":     mongifylab.EmbeddedTransform,
+		"CANDIDATO":   mongifylab.SimpleTransform,
+		"CARGO":       mongifylab.ReferencedTransform,
+		"PLEITO":      mongifylab.NxNTransform,
+		"CANDIDATURA": mongifylab.NxNTransform,
+	})
+	tree.Prepared.Cols["CANDIDATO"] = append(tree.Prepared.Cols["CANDIDATO"], "ALTERADO")
+	tree.Prepared.Types = map[string]map[string]string{"CANDIDATO": {"ALTERADO": "TIMESTAMP(6)"}}
+	tree.SetChangeTracking("CANDIDATO", "ALTERADO", nil)
+	tree.SetChangeTracking("CARGO", "ALTERADO", nil)
+
+	expected := map[string]mongifylab.Severity{
+		"error: CARGO: tracks changes by unknown column ALTERADO":                                                                              mongifylab.Error,
+		"warning: CANDIDATO: tracks changes by the time in ALTERADO, rows committed after a delta with an earlier time are missed by the next": mongifylab.Warning,
+		"error: CARGO: no primary key, its documents would have an empty _id":                                                                  mongifylab.Error,
+		"error: CANDIDATURA: references CARGO, which has no primary key":                                                                       mongifylab.Error,
+		"error: PARTIDO: more than one foreign key to CANDIDATO, they cannot be told apart":                                                    mongifylab.Error,
+		"error: PLEITO: N x N, but it has 0 foreign keys instead of two or more":                                                               mongifylab.Error,
+		"warning: ESTADO: cannot embed CIDADE, it would embed ESTADO back in a cycle":                                                          mongifylab.Warning,
+		"warning: ELEITOR: not mapped, it is left out of the documents":                                                                        mongifylab.Warning,
+		"warning: PARTIDO: embedded, but no mapped table it is embedded into is reached from a collection":                                     mongifylab.Warning,
+	}
+
+	issues := tree.Validate()
+	for _, issue := range issues {
+		if severity, found := expected[issue.String()]; !found || severity != issue.Severity {
+			t.Error("unexpected issue:", issue)
+		}
+		delete(expected, issue.String())
+	}
+	for issue := range expected {
+		t.Error("missing issue:", issue)
+	}
+
+	if !mongifylab.HasErrors(issues) {
+		t.Error("errors were not told")
+	}
+	if issues := newElectionTree().Validate(); mongifylab.HasErrors(issues) {
+		t.Error("unmapped tables are not errors:", issues)
+	}
+}
+
+func TestScriptsRefuseErrors(t *testing.T) {
+	sqlite, tree := newSQLiteTree(t)
+	defer sqlite.Close()
+
+	tree.SetComputed("PESSOA", []mongifylab.ComputedField{{Field: "iniciais", Hook: "iniciais"}})
+	scripts := map[string]func() error{
+		"collection": func() error { _, err := tree.CreateCollectionScript(sqlite); return err },
+		"delta":      func() error { _, err := tree.CreateDeltaScript(sqlite); return err },
+		"change log": func() error { _, err := tree.CreateChangeLogScript(); return err },
+		"validator":  func() error { _, err := tree.CreateValidatorScript(sqlite); return err },
+		"poll":       func() error { _, _, err := (&mongifylab.ChangePoller{Tree: tree}).Poll(sqlite); return err },
+	}
+	for name, script := range scripts {
+		err := script()
+		if invalid, ok := err.(*mongifylab.ValidationError); !ok || !mongifylab.HasErrors(invalid.Issues) {
+			t.Errorf("%s script: expected a validation error, got %v", name, err)
+		}
+	}
+
+	tree.RegisterHook("iniciais", func(row map[string]interface{}) interface{} { return nil })
+	for name, script := range scripts {
+		if name == "poll" {
+			continue // there is no change log
+		}
+		if err := script(); err != nil {
+			t.Errorf("%s script: %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package mongifylab
+
+import (
+	"bytes"
+	"strconv"
+)
+
+// CreateValidatorScript returns the script setting a $jsonSchema validator
+// on every collection, describing the layout of its documents: the objects,
+// arrays and fields they may hold, named as they are written.
+// Column types are not known, so fields are left untyped, but the values of
+// lookup tables asked for are queried from db.
+func (t *DependencyTree) CreateValidatorScript(db Querier) (string, error) {
+	if err := t.checkValid(); err != nil {
+		return "", err
+	}
+
+	enums, err := t.lookupEnums(db)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+
+	for _, table := range t.Root {
+		cols := t.prepareColumns(nil, table, table.Name, false)
+
+		buf.WriteString("/* " + table.Name + " */\n")
+		buf.WriteString("db.runCommand({collMod: \"" + t.CollectionName(table.Name) + "\", validator: {$jsonSchema: ")
+		t.writeObjectSchema(&buf, cols, []string{"_id"}, enums)
+		buf.WriteString("}})\n\n")
+	}
+
+	return buf.String(), nil
+}
+
+// writeObjectSchema writes the schema of an object holding cols,
+// the fields named by required must be present.
+// enums are the values allowed for lookup tables, by table.
+func (t *DependencyTree) writeObjectSchema(buf *bytes.Buffer, cols []*BsonColumn, required []string, enums map[string][]string) {
+	buf.WriteString("{bsonType: \"object\"")
+	t.writeProperties(buf, cols, required, nil, enums)
+	buf.WriteRune('}')
+}
+
+// writeProperties writes the fields required and the properties of cols,
+// the discriminator first if it may only be one of enum.
+// Variants among cols are written as oneOf the schemas of each,
+// or of the objects holding none.
+func (t *DependencyTree) writeProperties(buf *bytes.Buffer, cols []*BsonColumn, required []string, enum []string, enums map[string][]string) {
+	if len(required) > 0 {
+		buf.WriteString(", required: [")
+		for i, field := range required {
+			if i > 0 {
+				buf.WriteString(", ")
+			}
+			buf.WriteString(strconv.Quote(field))
+		}
+		buf.WriteRune(']')
+	}
+
+	field := t.discriminatorField()
+	buf.WriteString(", properties: {")
+	sep := ""
+	if enum != nil {
+		buf.WriteString(field + ": ")
+		writeEnum(buf, quoted(enum))
+		sep = ", "
+	}
+
+	var variants []*BsonColumn
+	for _, c := range cols {
+		if c.variant != "" {
+			variants = append(variants, c)
+			continue
+		}
+		if len(c.variants) > 0 {
+			enum = []string{c.value.(string)}
+		}
+
+		buf.WriteString(sep)
+		buf.WriteString(c.Field)
+		buf.WriteString(": ")
+		t.writeSchema(buf, c, enums)
+		sep = ", "
+	}
+	buf.WriteRune('}')
+
+	if len(variants) == 0 {
+		return
+	}
+
+	// the objects of no variant have the discriminator of their own
+	buf.WriteString(", oneOf: [{properties: {" + field + ": ")
+	writeEnum(buf, quoted(enum[:1]))
+	buf.WriteString("}}")
+	for _, variant := range variants {
+		buf.WriteString(", {bsonType: \"object\"")
+		t.writeProperties(buf, variant.InnerColumns, nil, variantValues(variant), enums)
+		buf.WriteRune('}')
+	}
+	buf.WriteRune(']')
+}
+
+// writeEnum writes the schema of a field that may only be one of values,
+// written as in the documents
+func writeEnum(buf *bytes.Buffer, values []string) {
+	buf.WriteString("{enum: [")
+	for i, value := range values {
+		if i > 0 {
+			buf.WriteString(", ")
+		}
+		buf.WriteString(value)
+	}
+	buf.WriteString("]}")
+}
+
+// quoted returns each of strs quoted
+func quoted(strs []string) []string {
+	var quoted []string
+	for _, str := range strs {
+		quoted = append(quoted, strconv.Quote(str))
+	}
+	return quoted
+}
+
+// writeSchema writes the schema of the field of c
+func (t *DependencyTree) writeSchema(buf *bytes.Buffer, c *BsonColumn, enums map[string][]string) {
+	switch {
+	case c.objectID:
+		buf.WriteString("{bsonType: \"objectId\"}")
+
+	case len(c.variants) > 0:
+		values := []string{c.value.(string)}
+		for _, variant := range c.variants {
+			values = append(values, variantValues(variant)...)
+		}
+		writeEnum(buf, quoted(values))
+
+	case c.pivot:
+		buf.WriteString("{bsonType: \"object\"}")
+
+	case c.IsArray:
+		buf.WriteString("{bsonType: \"array\"")
+		if added := t.added(c.Name); added != nil && added.Mode == ArrayTransform && added.MaxItems > 0 {
+			buf.WriteString(", maxItems: " + strconv.Itoa(added.MaxItems))
+		}
+		buf.WriteString(", items: ")
+		t.writeObjectSchema(buf, c.InnerColumns, nil, enums)
+		buf.WriteRune('}')
+
+	case len(c.InnerColumns) > 0:
+		// every field of _id identifies the document
+		var required []string
+		if c.Name == "_id" {
+			for _, inner := range c.InnerColumns {
+				required = append(required, inner.Field)
+			}
+		}
+		t.writeObjectSchema(buf, c.InnerColumns, required, enums)
+
+	case enums[c.Table] != nil && c.Name == t.lookupColumn(c.Table):
+		writeEnum(buf, enums[c.Table])
+
+	default:
+		buf.WriteString("{}")
+	}
+}
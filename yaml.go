@@ -0,0 +1,141 @@
+package mongifylab
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// LoadMappingYAML reads a YAML mapping file into the tree, see SetMapping.
+// The document is read as the JSON it stands for, so both formats read
+// alike and are checked alike. Keys may not be repeated.
+func (t *DependencyTree) LoadMappingYAML(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var doc interface{}
+	if err := yaml.UnmarshalStrict(data, &doc); err != nil {
+		return err
+	}
+	doc, err = jsonValue(doc)
+	if err != nil {
+		return err
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	return t.LoadMapping(bytes.NewReader(data))
+}
+
+// SaveMappingYAML writes the tree's mapping as a YAML mapping file,
+// with the same fields, in the same order, as SaveMapping
+func (t *DependencyTree) SaveMappingYAML(w io.Writer) error {
+	data, err := json.Marshal(t.Mapping())
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	doc, err := yamlValue(dec)
+	if err != nil {
+		return err
+	}
+
+	data, err = yaml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// jsonValue turns a value read by yaml.Unmarshal into one json.Marshal
+// writes, whose mappings are keyed by strings
+func jsonValue(val interface{}) (interface{}, error) {
+	switch v := val.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("yaml mapping: key %v is not a string", key)
+			}
+
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[name] = item
+		}
+		return m, nil
+	case []interface{}:
+		for i, item := range v {
+			item, err := jsonValue(item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = item
+		}
+	}
+
+	return val, nil
+}
+
+// yamlValue reads the next JSON value of dec as one yaml.Marshal writes,
+// keeping the order of keys
+func yamlValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok := tok.(type) {
+	case json.Delim:
+		var m yaml.MapSlice
+		var items []interface{}
+		for dec.More() {
+			var key interface{}
+			if tok == '{' {
+				if key, err = dec.Token(); err != nil {
+					return nil, err
+				}
+			}
+
+			item, err := yamlValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			if tok == '{' {
+				m = append(m, yaml.MapItem{Key: key, Value: item})
+			} else {
+				items = append(items, item)
+			}
+		}
+
+		// closing delimiter
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		if tok == '{' {
+			return m, nil
+		}
+		return items, nil
+	case json.Number:
+		if n, err := tok.Int64(); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(tok.String(), 64)
+	default:
+		return tok, nil
+	}
+}
@@ -0,0 +1,102 @@
+package mongifylab_test
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/victorMoneratto/mongifylab"
+)
+
+func TestMappingYAMLRoundTrip(t *testing.T) {
+	tree := newElectionTree()
+	tree.Add("ESTADO", mongifylab.EmbeddedTransform)
+	tree.Add("CIDADE", mongifylab.EmbeddedTransform)
+	tree.Add("CANDIDATO", mongifylab.SimpleTransform)
+	tree.Add("CANDIDATURA", mongifylab.NxNTransform)
+	tree.SetFilter("CANDIDATO", `NOME <> 'it''s: "#1"' AND ID > 10`, 12.5)
+	tree.SetChangeTracking("CANDIDATO", "ALTERADO", 42)
+	tree.SetFields("CANDIDATO", map[string]string{"NOME": "nome", "CIDADE": "true"})
+	tree.SetProjection("CANDIDATO", nil, []string{"PARTIDO"})
+
+	var buf bytes.Buffer
+	if err := tree.SaveMappingYAML(&buf); err != nil {
+		t.Fatal(err)
+	}
+	saved := buf.String()
+	for _, expected := range []string{
+		"version: 1\n",
+		"- table: CANDIDATO\n  mode: simple\n",
+		"  sample: 12.5\n",
+		"    CIDADE: \"true\"\n",
+		"  exclude:\n  - PARTIDO\n",
+	} {
+		if !strings.Contains(saved, expected) {
+			t.Errorf("missing %q in:\n%s", expected, saved)
+		}
+	}
+	if !strings.HasPrefix(saved, "version: 1\n") {
+		t.Error("fields are not in the order of the JSON mapping:\n" + saved)
+	}
+
+	loaded := newElectionTree()
+	if err := loaded.LoadMappingYAML(strings.NewReader(saved)); err != nil {
+		t.Fatal(err, saved)
+	}
+	if !reflect.DeepEqual(loaded.Mapping(), tree.Mapping()) {
+		t.Errorf("expected %+v, got %+v", tree.Mapping(), loaded.Mapping())
+	}
+}
+
+func TestMappingYAML(t *testing.T) {
+	tree := newElectionTree()
+	err := tree.LoadMappingYAML(strings.NewReader(`---
+# the states are written into the cities
+version: 1
+tables:
+- table: ESTADO
+  mode: &embedded embedded
+- table: CIDADE    # with its state
+  mode: *embedded
+- {table: CANDIDATURA, mode: nxn}
+-
+  table: CANDIDATO
+  mode: simple
+  where: >-
+    ID > 10
+    # not a comment
+  exclude: [PARTIDO]
+  rename:
+    NOME: nome
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mapping := tree.Mapping()
+	if len(mapping.Tables) != 4 {
+		t.Fatalf("unexpected mapping %+v", mapping)
+	}
+	candidato := mapping.Tables[0]
+	if candidato.Table != "CANDIDATO" || candidato.Where != "ID > 10 # not a comment" ||
+		!reflect.DeepEqual(candidato.Exclude, []string{"PARTIDO"}) || candidato.Rename["NOME"] != "nome" {
+		t.Errorf("unexpected table mapping %+v", candidato)
+	}
+	if mapping.Tables[1].Mode != mongifylab.NxNTransform || mapping.Tables[2].Mode != mongifylab.EmbeddedTransform {
+		t.Errorf("unexpected table mappings %+v", mapping.Tables)
+	}
+
+	for _, bad := range []string{
+		"",
+		"version: 1\ntables:\n  - table: CIDADE\n   mode: embedded\n",
+		"version: 1\ntables: [{table: CIDADE, mode: embedded}\n",
+		"version: 1\nversion: 1\ntables: []\n",
+		"version: 1\n1: CIDADE\ntables: []\n",
+		"version: one\ntables: []\n",
+	} {
+		if err := tree.LoadMappingYAML(strings.NewReader(bad)); err == nil {
+			t.Errorf("loaded bad mapping:\n%s", bad)
+		}
+	}
+}